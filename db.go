@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -28,3 +29,50 @@ func initDB() {
 		log.Fatalf("Unable to create database connection pool: %v", err)
 	}
 }
+
+// reloadChannel is the channel to notify after a migration, as in PostgREST:
+// NOTIFY pgrst, 'reload schema'
+const reloadChannel = "pgrst"
+
+// listenForSchemaReload reloads the schema caches whenever reloadChannel is notified.
+// It keeps its own connection and reconnects after a failure until ctx is done.
+func listenForSchemaReload(ctx context.Context, cfg *pgx.ConnConfig) {
+	for {
+		err := waitForSchemaReload(ctx, cfg)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Schema reload listener failed, retrying:", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// waitForSchemaReload listens on reloadChannel until the connection fails
+func waitForSchemaReload(ctx context.Context, cfg *pgx.ConnConfig) error {
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+reloadChannel); err != nil {
+		return err
+	}
+	// The schema may have changed while no listener was connected
+	reloadSchemaCaches()
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Payload == "" || n.Payload == "reload schema" {
+			log.Println("Reloading schema cache")
+			reloadSchemaCaches()
+		}
+	}
+}
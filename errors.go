@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// errorResponse is the JSON body sent for a failed request. Database errors carry
+// their SQLSTATE as Code; errors raised by the server use a snake_case kind.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// writeError sends body as JSON with the given status
+func writeError(w http.ResponseWriter, status int, body errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// sqlStateStatus maps a SQLSTATE to the HTTP status reported for it, first by
+// exact code and then by class (the first two characters). Functions can pick
+// the status themselves with a PTxxx code, e.g. RAISE ... USING ERRCODE = 'PT403'.
+func sqlStateStatus(code string) int {
+	if rest, ok := strings.CutPrefix(code, "PT"); ok {
+		if status, err := strconv.Atoi(rest); err == nil && status >= 100 && status <= 599 {
+			return status
+		}
+	}
+
+	switch code {
+	case "42P01", "42883": // undefined_table, undefined_function
+		return http.StatusNotFound
+	case "42501": // insufficient_privilege
+		return http.StatusForbidden
+	case "23505", "23503", "23P01": // unique, foreign key and exclusion violations
+		return http.StatusConflict
+	case "57014": // query_canceled, e.g. by statement_timeout
+		return http.StatusGatewayTimeout
+	case "25006": // read_only_sql_transaction
+		return http.StatusMethodNotAllowed
+	case "P0001": // raise_exception from PL/pgSQL
+		return http.StatusBadRequest
+	}
+
+	if len(code) < 2 {
+		return http.StatusInternalServerError
+	}
+	switch code[:2] {
+	case "08": // connection exception
+		return http.StatusServiceUnavailable
+	case "22", "23", "42": // data exception, integrity constraint violation, syntax error or access rule violation
+		return http.StatusBadRequest
+	case "28": // invalid authorization specification
+		return http.StatusForbidden
+	case "53": // insufficient resources
+		return http.StatusServiceUnavailable
+	case "54": // program limit exceeded
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeDBError reports an error returned by Postgres. A *pgconn.PgError is passed
+// on with its SQLSTATE, message, detail and hint; anything else is logged and
+// reported without the driver's text.
+func writeDBError(w http.ResponseWriter, err error) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		writeError(w, sqlStateStatus(pgErr.Code), errorResponse{
+			Code:    pgErr.Code,
+			Message: pgErr.Message,
+			Details: pgErr.Detail,
+			Hint:    pgErr.Hint,
+		})
+		return
+	}
+	log.Println("Database error:", err)
+	writeError(w, http.StatusInternalServerError, errorResponse{
+		Code:    "internal_error",
+		Message: "Query execution failed",
+	})
+}
+
+// writeBuildError reports an error from building a query, separating problems
+// with the request from failures on our side
+func writeBuildError(w http.ResponseWriter, err error) {
+	var queryErr *QueryError
+	var relErr *RelationshipError
+	var ambiguousErr *AmbiguousRelationshipError
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &queryErr):
+		writeError(w, http.StatusBadRequest, errorResponse{
+			Code:    queryErr.Code,
+			Message: queryErr.Message,
+			Details: "query parameter: " + queryErr.Param,
+		})
+	case errors.Is(err, errInvalidSelect):
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "invalid_select", Message: err.Error()})
+	case errors.As(err, &ambiguousErr):
+		writeError(w, http.StatusMultipleChoices, errorResponse{
+			Code:    "ambiguous_relationship",
+			Message: err.Error(),
+			Hint:    "Pick one of the relationships with " + ambiguousErr.Embed + "!<hint>(...)",
+		})
+	case errors.As(err, &relErr):
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "relationship_not_found", Message: err.Error()})
+	case errors.Is(err, errTableNotFound):
+		writeError(w, http.StatusNotFound, errorResponse{
+			Code:    "table_not_found",
+			Message: err.Error(),
+			Hint:    "Tables created since the schema cache was loaded appear after NOTIFY pgrst, 'reload schema'",
+		})
+	case errors.Is(err, errMissingFilters):
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "missing_filters", Message: err.Error()})
+	case errors.As(err, &pgErr):
+		// Loading the schema cache or resolving a function failed in Postgres
+		writeDBError(w, err)
+	default:
+		log.Println("Failed to build query:", err)
+		writeError(w, http.StatusInternalServerError, errorResponse{
+			Code:    "internal_error",
+			Message: "Failed to build query",
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TestSQLStateStatus tests the SQLSTATE to HTTP status mapping
+func TestSQLStateStatus(t *testing.T) {
+	tests := map[string]int{
+		"42P01": http.StatusNotFound,
+		"42703": http.StatusBadRequest,
+		"23505": http.StatusConflict,
+		"42501": http.StatusForbidden,
+		"57014": http.StatusGatewayTimeout,
+		"22P02": http.StatusBadRequest,
+		"XX000": http.StatusInternalServerError,
+		"PT403": http.StatusForbidden,
+		"PT999": http.StatusInternalServerError,
+	}
+	for code, want := range tests {
+		if got := sqlStateStatus(code); got != want {
+			t.Errorf("%s: expected %d, got %d", code, want, got)
+		}
+	}
+}
+
+// TestWriteDBError tests that Postgres errors keep their fields and other errors are not leaked
+func TestWriteDBError(t *testing.T) {
+	w := httptest.NewRecorder()
+	pgErr := &pgconn.PgError{Code: "23505", Message: "duplicate key", Detail: "Key (id)=(1) already exists.", Hint: "use upsert"}
+	writeDBError(w, fmt.Errorf("insert: %w", pgErr))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", w.Code)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected a JSON body: %v", err)
+	}
+	want := errorResponse{Code: "23505", Message: "duplicate key", Details: "Key (id)=(1) already exists.", Hint: "use upsert"}
+	if body != want {
+		t.Errorf("Unexpected body: %+v", body)
+	}
+
+	w = httptest.NewRecorder()
+	writeDBError(w, errors.New("conn closed: secret driver detail"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != `{"code":"internal_error","message":"Query execution failed"}`+"\n" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+)
+
+// filterOperators are the operators accepted in column filters such as id=eq.5.
+// not negates the operator that follows it, as in id=not.in.(1,2).
+var filterOperators = map[string]bool{
+	"eq": true, "neq": true, "gt": true, "lt": true, "gte": true, "lte": true,
+	"like": true, "ilike": true, "match": true, "imatch": true,
+	"in": true, "is": true, "isdistinct": true, "not": true,
+	"cs": true, "cd": true, "ov": true,
+	"sl": true, "sr": true, "nxr": true, "nxl": true, "adj": true,
+	"fts": true, "plfts": true, "phfts": true, "wfts": true,
+}
+
+// isFilterOperator reports whether op is a filter operator, ignoring the
+// (language) argument of the full-text operators
+func isFilterOperator(op string) bool {
+	name, _, _ := strings.Cut(op, "(")
+	return filterOperators[name]
+}
+
+// textSearchFunctions map the full-text operators to the function that parses their query
+var textSearchFunctions = map[string]string{
+	"fts":   "to_tsquery",
+	"plfts": "plainto_tsquery",
+	"phfts": "phraseto_tsquery",
+	"wfts":  "websearch_to_tsquery",
+}
+
+// containmentOperators map the array, range and jsonb operators to their SQL
+// operator and the kinds of literal they accept
+var containmentOperators = map[string]struct {
+	sql    string
+	ranges bool // accepts a range literal like [1,10)
+	arrays bool // accepts an array literal like {a,b}
+	json   bool // accepts a jsonb object or array
+}{
+	"cs":  {sql: "@>", ranges: true, arrays: true, json: true},
+	"cd":  {sql: "<@", ranges: true, arrays: true, json: true},
+	"ov":  {sql: "&&", ranges: true, arrays: true},
+	"sl":  {sql: "<<", ranges: true},
+	"sr":  {sql: ">>", ranges: true},
+	"nxr": {sql: "&<", ranges: true},
+	"nxl": {sql: "&>", ranges: true},
+	"adj": {sql: "-|-", ranges: true},
+}
+
+// filterColumn is what a filter compares or an order sorts by: a column or a JSON
+// path into one
+type filterColumn interface {
+	exp.Expression
+	exp.Comparable
+	exp.Inable
+	exp.Isable
+	exp.Likeable
+	exp.Orderable
+}
+
+// buildFilter compiles a [not.]operator.value filter on col. colType is the column's
+// type when it is known and param the query parameter the filter came from, for
+// error reports. Values are always bound.
+func buildFilter(col filterColumn, colType, param, filter string) (exp.Expression, error) {
+	op, v, found := strings.Cut(filter, ".")
+	negate := op == "not"
+	if negate {
+		op, v, found = strings.Cut(v, ".")
+	}
+	if !found {
+		return nil, &QueryError{
+			Code:    "invalid_filter",
+			Param:   param,
+			Message: fmt.Sprintf("'%s' is not of the form operator.value", filter),
+		}
+	}
+
+	// Full-text operators take an optional language: fts(english)
+	op, language, hasLanguage := strings.Cut(op, "(")
+	if hasLanguage {
+		var closed bool
+		if language, closed = strings.CutSuffix(language, ")"); !closed || language == "" || textSearchFunctions[op] == "" {
+			return nil, &QueryError{
+				Code:    "bad_operator",
+				Param:   param,
+				Message: fmt.Sprintf("unknown operator '%s(%s'", op, language),
+			}
+		}
+	}
+
+	// negated is set where Postgres has a dedicated negated operator; the others
+	// are wrapped in NOT
+	var expr, negated exp.Expression
+	switch op {
+	case "eq", "neq", "gt", "lt", "gte", "lte", "like", "ilike", "match", "imatch", "isdistinct":
+		v = unquoteValue(v)
+	}
+	switch op {
+	case "eq":
+		expr, negated = col.Eq(v), col.Neq(v)
+	case "neq":
+		expr, negated = col.Neq(v), col.Eq(v)
+	case "gt":
+		expr = col.Gt(v)
+	case "lt":
+		expr = col.Lt(v)
+	case "gte":
+		expr = col.Gte(v)
+	case "lte":
+		expr = col.Lte(v)
+	case "like":
+		// * stands in for % so patterns need no URL encoding
+		pattern := strings.ReplaceAll(v, "*", "%")
+		expr, negated = col.Like(pattern), col.NotLike(pattern)
+	case "ilike":
+		pattern := strings.ReplaceAll(v, "*", "%")
+		expr, negated = col.ILike(pattern), col.NotILike(pattern)
+	case "match":
+		expr, negated = col.RegexpLike(v), col.RegexpNotLike(v)
+	case "imatch":
+		expr, negated = col.RegexpILike(v), col.RegexpNotILike(v)
+	case "in":
+		values := parseListValue(v)
+		expr, negated = col.In(values), col.NotIn(values)
+	case "is":
+		switch strings.ToLower(v) {
+		case "null":
+			expr, negated = col.IsNull(), col.IsNotNull()
+		case "true":
+			expr, negated = col.IsTrue(), col.IsNotTrue()
+		case "false":
+			expr, negated = col.IsFalse(), col.IsNotFalse()
+		case "unknown":
+			expr, negated = goqu.L("(? IS UNKNOWN)", col), goqu.L("(? IS NOT UNKNOWN)", col)
+		default:
+			return nil, &QueryError{
+				Code:    "invalid_filter",
+				Param:   param,
+				Message: fmt.Sprintf("is expects null, true, false or unknown, got '%s'", v),
+			}
+		}
+	case "isdistinct":
+		expr, negated = goqu.L("(? IS DISTINCT FROM ?)", col, v), goqu.L("(? IS NOT DISTINCT FROM ?)", col, v)
+	case "cs", "cd", "ov", "sl", "sr", "nxr", "nxl", "adj":
+		literal, err := containerLiteral(op, v)
+		if err != nil {
+			return nil, &QueryError{Code: "invalid_filter", Param: param, Message: err.Error()}
+		}
+		// The literal is cast to the column's array, range or jsonb type: left
+		// untyped, range operators are ambiguous with their multirange overloads
+		operand := "?"
+		if colType != "" {
+			operand = "?::" + colType
+		}
+		expr = goqu.L(fmt.Sprintf("(? %s %s)", containmentOperators[op].sql, operand), col, literal)
+	case "fts", "plfts", "phfts", "wfts":
+		expr = textSearch(col, colType, textSearchFunctions[op], language, v)
+	default:
+		return nil, &QueryError{
+			Code:    "bad_operator",
+			Param:   param,
+			Message: fmt.Sprintf("unknown operator '%s'", op),
+		}
+	}
+
+	switch {
+	case !negate:
+		return expr, nil
+	case negated != nil:
+		return negated, nil
+	default:
+		return goqu.L("NOT ?", expr), nil
+	}
+}
+
+// logicOperators are the query parameters and tree nodes that group filters
+var logicOperators = map[string]bool{"or": true, "and": true, "not.or": true, "not.and": true}
+
+// buildLogicFilter compiles a filter group such as or=(status.eq.draft,and(a.gt.1,b.lt.2)).
+// op is or, and, not.or or not.and; value is the parenthesized list of members, each
+// either column.[not.]operator.value or a nested group.
+func buildLogicFilter(table string, def *Table, op, value string) (exp.Expression, error) {
+	invalid := func(msg string) error {
+		return &QueryError{Code: "invalid_filter", Param: op, Message: msg}
+	}
+	if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+		return nil, invalid(fmt.Sprintf("'%s' must be a parenthesized list of filters", value))
+	}
+	members, err := splitLogicMembers(value[1 : len(value)-1])
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+
+	exprs := make([]exp.Expression, 0, len(members))
+	for _, member := range members {
+		if name, rest, ok := strings.Cut(member, "("); ok && logicOperators[name] {
+			expr, err := buildLogicFilter(table, def, name, "("+rest)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, expr)
+			continue
+		}
+
+		column, filter, found := strings.Cut(member, ".")
+		if !found || column == "" {
+			return nil, invalid(fmt.Sprintf("'%s' is not of the form column.operator.value", member))
+		}
+		target, err := filterTarget("invalid_filter", op, column)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkColumn(def, op, target.Column); err != nil {
+			return nil, err
+		}
+		col, colType := targetExpr(table, def, target)
+		expr, err := buildFilter(col, colType, op, filter)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+
+	group, negate := strings.CutPrefix(op, "not.")
+	var expr exp.Expression = goqu.And(exprs...)
+	if group == "or" {
+		expr = goqu.Or(exprs...)
+	}
+	if negate {
+		return goqu.L("NOT ?", expr), nil
+	}
+	return expr, nil
+}
+
+// splitLogicMembers splits the inside of a filter group at its top-level commas.
+// Commas inside (), {}, [] or double quotes belong to a value such as in.(1,2),
+// cs.{a,b} or ov.[1,10).
+func splitLogicMembers(s string) ([]string, error) {
+	var members []string
+	depth, start := 0, 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '{' || c == '[':
+			depth++
+		case c == ')' || c == '}' || c == ']':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("unbalanced '%c' at position %d", c, i+1)
+			}
+		case c == ',' && depth == 0:
+			members = append(members, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if depth != 0 || quoted {
+		return nil, errors.New("unclosed parenthesis, bracket or quote")
+	}
+	members = append(members, strings.TrimSpace(s[start:]))
+	for _, m := range members {
+		if m == "" {
+			return nil, errors.New("empty filter in group")
+		}
+	}
+	return members, nil
+}
+
+// textSearch matches col against the query v parsed by fn. Text columns are turned
+// into a tsvector first; tsvector columns are matched directly. The language, when
+// given, is bound and cast to regconfig for both sides.
+func textSearch(col filterColumn, colType, fn, language, v string) exp.Expression {
+	if language == "" {
+		if colType == "tsvector" {
+			return goqu.L(fmt.Sprintf("(? @@ %s(?))", fn), col, v)
+		}
+		return goqu.L(fmt.Sprintf("(to_tsvector(?) @@ %s(?))", fn), col, v)
+	}
+	if colType == "tsvector" {
+		return goqu.L(fmt.Sprintf("(? @@ %s(?::regconfig, ?))", fn), col, language, v)
+	}
+	return goqu.L(fmt.Sprintf("(to_tsvector(?::regconfig, ?) @@ %s(?::regconfig, ?))", fn), language, col, language, v)
+}
+
+// containerLiteral checks the value of an array, range or jsonb operator and
+// returns the Postgres literal to bind. Array literals are re-quoted item by item
+// so {a,"b,c"} reaches Postgres as {"a","b,c"}.
+func containerLiteral(op, v string) (string, error) {
+	kinds := containmentOperators[op]
+	switch {
+	case kinds.json && (strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[")) && json.Valid([]byte(v)):
+		return v, nil
+	case kinds.arrays && strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}"):
+		items := parseListValue(v)
+		if len(items) == 1 && items[0] == "" && strings.TrimSpace(v[1:len(v)-1]) == "" {
+			return "{}", nil
+		}
+		quoted := make([]string, len(items))
+		for i, item := range items {
+			quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(item) + `"`
+		}
+		return "{" + strings.Join(quoted, ",") + "}", nil
+	case kinds.ranges && isRangeLiteral(v):
+		return v, nil
+	}
+
+	var want []string
+	if kinds.arrays {
+		want = append(want, "an array like {a,b}")
+	}
+	if kinds.ranges {
+		want = append(want, "a range like [1,10)")
+	}
+	if kinds.json {
+		want = append(want, "a JSON object or array")
+	}
+	return "", fmt.Errorf("%s expects %s, got '%s'", op, strings.Join(want, " or "), v)
+}
+
+// isRangeLiteral reports whether v looks like [lower,upper) with any bracket pair
+// and optional (empty) bounds
+func isRangeLiteral(v string) bool {
+	if len(v) < 3 || !strings.ContainsAny(v[:1], "[(") || !strings.ContainsAny(v[len(v)-1:], "])") {
+		return false
+	}
+	return len(parseListValue(v[1:len(v)-1])) == 2
+}
+
+// parseListValue splits a list value like (1,2,3), {a,b} or ("a,b",c) into its
+// items. The parentheses or braces are optional and double quotes protect commas,
+// with \ escaping a quote inside them.
+func parseListValue(v string) []string {
+	if (strings.HasPrefix(v, "(") && strings.HasSuffix(v, ")")) || (strings.HasPrefix(v, "{") && strings.HasSuffix(v, "}")) {
+		v = v[1 : len(v)-1]
+	}
+
+	var items []string
+	var cur strings.Builder
+	quoted, wasQuoted := false, false
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(v):
+			i++
+			cur.WriteByte(v[i])
+		case c == '"':
+			quoted = !quoted
+			wasQuoted = true
+		case c == ',' && !quoted:
+			items = append(items, listItem(cur.String(), wasQuoted))
+			cur.Reset()
+			wasQuoted = false
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return append(items, listItem(cur.String(), wasQuoted))
+}
+
+// unquoteValue strips the double quotes that protect commas and parentheses in a
+// value, as in or=(name.eq."Smith, John"), unescaping \" inside them
+func unquoteValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1])
+}
+
+// listItem trims the spaces around an unquoted list item
+func listItem(s string, quoted bool) string {
+	if quoted {
+		return s
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// renderFilter compiles filter on t.c of type colType and returns the prepared WHERE
+// clause and its values
+func renderFilter(t *testing.T, colType, filter string) (string, []any) {
+	t.Helper()
+	expr, err := buildFilter(goqu.T("t").Col("c"), colType, "c", filter)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", filter, err)
+	}
+	sql, values, err := goqu.Dialect("postgres").From("t").Where(expr).Prepared(true).ToSQL()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", filter, err)
+	}
+	_, where, _ := strings.Cut(sql, " WHERE ")
+	return where, values
+}
+
+// TestBuildFilterOperators tests the SQL generated for every operator and its negation
+func TestBuildFilterOperators(t *testing.T) {
+	tests := []struct {
+		filter string
+		where  string
+		values []any
+	}{
+		{"eq.5", `("t"."c" = $1)`, []any{"5"}},
+		{`eq."a,b(c)"`, `("t"."c" = $1)`, []any{"a,b(c)"}},
+		{"not.eq.5", `("t"."c" != $1)`, []any{"5"}},
+		{"neq.5", `("t"."c" != $1)`, []any{"5"}},
+		{"gt.5", `("t"."c" > $1)`, []any{"5"}},
+		{"not.gte.5", `NOT ("t"."c" >= $1)`, []any{"5"}},
+		{"like.*go*", `("t"."c" LIKE $1)`, []any{"%go%"}},
+		{"ilike.Go*", `("t"."c" ILIKE $1)`, []any{"Go%"}},
+		{"not.ilike.*go", `("t"."c" NOT ILIKE $1)`, []any{"%go"}},
+		{"match.^a.c$", `("t"."c" ~ $1)`, []any{"^a.c$"}},
+		{"imatch.^abc", `("t"."c" ~* $1)`, []any{"^abc"}},
+		{"not.match.x", `("t"."c" !~ $1)`, []any{"x"}},
+		{"in.(1,2,3)", `("t"."c" IN ($1, $2, $3))`, []any{"1", "2", "3"}},
+		{`not.in.("a,b",c)`, `("t"."c" NOT IN ($1, $2))`, []any{"a,b", "c"}},
+		{"is.null", `("t"."c" IS NULL)`, nil},
+		{"not.is.null", `("t"."c" IS NOT NULL)`, nil},
+		{"is.TRUE", `("t"."c" IS TRUE)`, nil},
+		{"is.unknown", `("t"."c" IS UNKNOWN)`, nil},
+		{"isdistinct.5", `("t"."c" IS DISTINCT FROM $1)`, []any{"5"}},
+		{"not.isdistinct.5", `("t"."c" IS NOT DISTINCT FROM $1)`, []any{"5"}},
+		{"cs.{a,b}", `("t"."c" @> $1)`, []any{`{"a","b"}`}},
+		{`cs.{"a b","c\"d"}`, `("t"."c" @> $1)`, []any{`{"a b","c\"d"}`}},
+		{"cd.{}", `("t"."c" <@ $1)`, []any{"{}"}},
+		{`cs.{"tags":["go"]}`, `("t"."c" @> $1)`, []any{`{"tags":["go"]}`}},
+		{"ov.[1,10)", `("t"."c" && $1)`, []any{"[1,10)"}},
+		{"not.ov.{1,2}", `NOT ("t"."c" && $1)`, []any{`{"1","2"}`}},
+		{"sl.(,5]", `("t"."c" << $1)`, []any{"(,5]"}},
+		{"sr.[1,5]", `("t"."c" >> $1)`, []any{"[1,5]"}},
+		{"nxr.[1,5)", `("t"."c" &< $1)`, []any{"[1,5)"}},
+		{"nxl.[1,5)", `("t"."c" &> $1)`, []any{"[1,5)"}},
+		{`adj.["2024-01-01 10:00","2024-01-01 12:00")`, `("t"."c" -|- $1)`, []any{`["2024-01-01 10:00","2024-01-01 12:00")`}},
+	}
+
+	for _, tt := range tests {
+		where, values := renderFilter(t, "", tt.filter)
+		if where != tt.where {
+			t.Errorf("%s: expected %s, got %s", tt.filter, tt.where, where)
+		}
+		if len(values) != len(tt.values) || (len(values) > 0 && !reflect.DeepEqual(values, tt.values)) {
+			t.Errorf("%s: expected values %v, got %v", tt.filter, tt.values, values)
+		}
+	}
+}
+
+// TestBuildFilterTypedContainment tests that containment and range literals are cast to the column type
+func TestBuildFilterTypedContainment(t *testing.T) {
+	tests := []struct {
+		colType string
+		filter  string
+		where   string
+	}{
+		{"tstzrange", `ov.["2024-01-01","2024-01-02")`, `("t"."c" && $1::tstzrange)`},
+		{"int4range", "not.adj.[1,5)", `NOT ("t"."c" -|- $1::int4range)`},
+		{"integer[]", "cs.{1,2}", `("t"."c" @> $1::integer[])`},
+		{"jsonb", `cd.{"a":1}`, `("t"."c" <@ $1::jsonb)`},
+	}
+
+	for _, tt := range tests {
+		where, _ := renderFilter(t, tt.colType, tt.filter)
+		if where != tt.where {
+			t.Errorf("%s on %s: expected %s, got %s", tt.filter, tt.colType, tt.where, where)
+		}
+	}
+}
+
+// TestBuildFilterTextSearch tests the full-text operators on text and tsvector columns
+func TestBuildFilterTextSearch(t *testing.T) {
+	tests := []struct {
+		colType string
+		filter  string
+		where   string
+		values  []any
+	}{
+		{"text", "fts.cat & dog", `(to_tsvector("t"."c") @@ to_tsquery($1))`, []any{"cat & dog"}},
+		{"text", "plfts(english).fat cats", `(to_tsvector($1::regconfig, "t"."c") @@ plainto_tsquery($2::regconfig, $3))`, []any{"english", "english", "fat cats"}},
+		{"tsvector", "phfts(french).le chat", `("t"."c" @@ phraseto_tsquery($1::regconfig, $2))`, []any{"french", "le chat"}},
+		{"tsvector", "not.wfts.\"go lang\" -java", `NOT ("t"."c" @@ websearch_to_tsquery($1))`, []any{`"go lang" -java`}},
+	}
+
+	for _, tt := range tests {
+		where, values := renderFilter(t, tt.colType, tt.filter)
+		if where != tt.where || !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s on %s: expected %s %v, got %s %v", tt.filter, tt.colType, tt.where, tt.values, where, values)
+		}
+	}
+
+	for _, filter := range []string{"fts(english.cat", "fts().cat", "eq(english).cat"} {
+		if _, err := buildFilter(goqu.T("t").Col("c"), "text", "c", filter); err == nil {
+			t.Errorf("%s: expected an error", filter)
+		}
+	}
+}
+
+// TestBuildFilterErrors tests that malformed filters are rejected
+func TestBuildFilterErrors(t *testing.T) {
+	for filter, code := range map[string]string{
+		"5":           "invalid_filter",
+		"not.eq":      "invalid_filter",
+		"is.maybe":    "invalid_filter",
+		"equals.5":    "bad_operator",
+		"not.not.5":   "bad_operator",
+		"not.nope.5":  "bad_operator",
+		"cs.5":        "invalid_filter",
+		"sl.{1,2}":    "invalid_filter",
+		"adj.[1,2,3]": "invalid_filter",
+		"ov.{a,b":     "invalid_filter",
+	} {
+		_, err := buildFilter(goqu.T("t").Col("c"), "", "c", filter)
+		queryErr, ok := err.(*QueryError)
+		if !ok || queryErr.Code != code {
+			t.Errorf("%s: expected %s, got: %v", filter, code, err)
+		}
+	}
+}
+
+// TestBuildLogicFilter tests nested and negated or/and groups
+func TestBuildLogicFilter(t *testing.T) {
+	tests := []struct {
+		query  string
+		where  string
+		values []any
+	}{
+		{
+			"or=(first_name.eq.A,and(id.gt.2,id.lt.5))",
+			`WHERE (("authors"."first_name" = $1) OR (("authors"."id" > $2) AND ("authors"."id" < $3)))`,
+			[]any{"A", "2", "5"},
+		},
+		{
+			"not.and=(id.in.(1,2),last_name.not.is.null)",
+			`WHERE NOT (("authors"."id" IN ($1, $2)) AND ("authors"."last_name" IS NOT NULL))`,
+			[]any{"1", "2"},
+		},
+		{
+			"or=(id.eq.1,not.or(first_name.like.*a*,first_name.eq.\"x,y\"))&last_name=eq.B",
+			`WHERE (("authors"."last_name" = $1) AND (("authors"."id" = $2) OR NOT (("authors"."first_name" LIKE $3) OR ("authors"."first_name" = $4))))`,
+			[]any{"B", "1", "%a%", "x,y"},
+		},
+	}
+
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		sql, err := BuildQuery(testContext(), nil, "authors", params)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.query, err)
+			continue
+		}
+		if !strings.HasSuffix(sql.Query, tt.where) || !reflect.DeepEqual(sql.Values, tt.values) {
+			t.Errorf("%s: expected %s %v, got: %s %v", tt.query, tt.where, tt.values, sql.Query, sql.Values)
+		}
+	}
+
+	for query, code := range map[string]string{
+		"or=id.eq.1":              "invalid_filter",
+		"or=(id.eq.1,)":           "invalid_filter",
+		"and=(id.in.(1,2)":        "invalid_filter",
+		"or=(id)":                 "invalid_filter",
+		"or=(nickname.eq.x)":      "unknown_column",
+		"or=(id.eq.1,id.bogus.2)": "bad_operator",
+	} {
+		params, _ := url.ParseQuery(query)
+		_, err := BuildQuery(testContext(), nil, "authors", params)
+		queryErr, ok := err.(*QueryError)
+		if !ok || queryErr.Code != code {
+			t.Errorf("%s: expected %s, got: %v", query, code, err)
+		}
+	}
+}
@@ -4,48 +4,247 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 )
 
 func HandleSelect(w http.ResponseWriter, r *http.Request) {
 	table := chi.URLParam(r, "table")
 	log.Println("Table requested:", table)
-	tenants := r.Header.Get("X-Tenant-ID")
-	log.Println("Tenant ID:", tenants)
-	if tenants == "" {
-		http.Error(w, "Missing X-Tenant-ID header", http.StatusBadRequest)
+	ctx, tx, ok := beginTenantTx(context.Background(), w, r)
+	if !ok {
 		return
 	}
-	ctx := context.Background()
-	tx, err := DB.Begin(ctx)
+	defer tx.Rollback(ctx)
+
+	sql, err := BuildQuery(ctx, tx, table, r.URL.Query())
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	log.Println("SQL Query is:", sql.Query)
+	log.Println("SQL Values are:", sql.Values)
+	rows, err := tx.Query(ctx, sql.Query, sql.Values...)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	results := scanRows(rows)
+	if err := rows.Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// HandleInsert inserts the JSON object or array in the request body into the table
+func HandleInsert(w http.ResponseWriter, r *http.Request) {
+	table := chi.URLParam(r, "table")
+	log.Println("Table requested for insert:", table)
+	payload, ok := readPayload(w, r)
+	if !ok {
+		return
+	}
+	prefs := parsePrefer(r)
+
+	ctx, tx, ok := beginTenantTx(context.Background(), w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	sql, err := BuildInsert(ctx, tx, table, r.URL.Query(), payload, prefs)
 	if err != nil {
-		http.Error(w, "Failed to start transaction", http.StatusInternalServerError)
+		writeBuildError(w, err)
+		return
+	}
+	results, _, ok := runMutation(ctx, w, tx, sql, prefs)
+	if !ok {
+		return
+	}
+
+	if prefs.Resolution == "merge-duplicates" || prefs.Resolution == "ignore-duplicates" {
+		w.Header().Set("Preference-Applied", "resolution="+prefs.Resolution)
+	}
+	switch prefs.Return {
+	case "representation":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(results)
+	case "headers-only":
+		if len(results) == 1 {
+			if location := locationFor(ctx, tx, table, results[0]); location != "" {
+				w.Header().Set("Location", location)
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// HandleUpdate sets the columns in the JSON body on every row matching the filters
+func HandleUpdate(w http.ResponseWriter, r *http.Request) {
+	table := chi.URLParam(r, "table")
+	log.Println("Table requested for update:", table)
+	payload, ok := readPayload(w, r)
+	if !ok {
+		return
+	}
+	if payload.Rows != 1 {
+		writeError(w, http.StatusBadRequest, errorResponse{
+			Code:    "invalid_body",
+			Message: "PATCH expects a single JSON object",
+		})
+		return
+	}
+	prefs := parsePrefer(r)
+
+	ctx, tx, ok := beginTenantTx(context.Background(), w, r)
+	if !ok {
 		return
 	}
 	defer tx.Rollback(ctx)
 
-	// Tenant isolation: ensure queries are scoped to the tenant
-	log.Println("Setting the Saearch Path")
-	_, err = tx.Exec(ctx, fmt.Sprintf(`SET LOCAL search_path TO "%s"`, tenants))
+	sql, err := BuildUpdate(ctx, tx, table, r.URL.Query(), payload, prefs)
 	if err != nil {
-		http.Error(w, "Failed to set tenant context", http.StatusInternalServerError)
+		writeBuildError(w, err)
+		return
+	}
+	results, _, ok := runMutation(ctx, w, tx, sql, prefs)
+	if !ok {
 		return
 	}
 
-	sql := BuildQuery(ctx, tx, table, r.URL.Query())
+	if prefs.Return == "representation" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleDelete deletes every row matching the filters
+func HandleDelete(w http.ResponseWriter, r *http.Request) {
+	table := chi.URLParam(r, "table")
+	log.Println("Table requested for delete:", table)
+	prefs := parsePrefer(r)
+
+	ctx, tx, ok := beginTenantTx(context.Background(), w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	sql, err := BuildDelete(ctx, tx, table, r.URL.Query(), prefs)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	results, count, ok := runMutation(ctx, w, tx, sql, prefs)
+	if !ok {
+		return
+	}
+
+	if prefs.Count == "exact" {
+		w.Header().Set("Content-Range", fmt.Sprintf("*/%d", count))
+	}
+	if prefs.Return == "representation" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readPayload reads and normalizes the JSON request body of a write.
+// On failure the error response is already written and ok is false.
+func readPayload(w http.ResponseWriter, r *http.Request) (Payload, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "invalid_body", Message: "Failed to read request body"})
+		return Payload{}, false
+	}
+	payload, err := parsePayload(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "invalid_body", Message: "Invalid request body", Details: err.Error()})
+		return Payload{}, false
+	}
+	return payload, true
+}
+
+// runMutation executes a write and commits it, reading the written rows back when
+// the client asked for them. It also returns the number of affected rows.
+// On failure the error response is already written.
+func runMutation(ctx context.Context, w http.ResponseWriter, tx pgx.Tx, sql SQLQuery, prefs Preferences) ([]map[string]interface{}, int64, bool) {
 	log.Println("SQL Query is:", sql.Query)
 	log.Println("SQL Values are:", sql.Values)
-	rows, err := tx.Query(ctx, sql.Query, sql.Values...)
+
+	var results []map[string]interface{}
+	var count int64
+	if prefs.Returning() {
+		rows, err := tx.Query(ctx, sql.Query, sql.Values...)
+		if err != nil {
+			writeDBError(w, err)
+			return nil, 0, false
+		}
+		results = scanRows(rows)
+		if err := rows.Err(); err != nil {
+			writeDBError(w, err)
+			return nil, 0, false
+		}
+		count = int64(len(results))
+	} else {
+		tag, err := tx.Exec(ctx, sql.Query, sql.Values...)
+		if err != nil {
+			writeDBError(w, err)
+			return nil, 0, false
+		}
+		count = tag.RowsAffected()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeDBError(w, err)
+		return nil, 0, false
+	}
+	return results, count, true
+}
+
+// locationFor builds the Location of an inserted row from the table's primary key
+func locationFor(ctx context.Context, db Querier, table string, row map[string]interface{}) string {
+	cache, err := getSchemaCache(ctx, db)
 	if err != nil {
-		http.Error(w, "Query execution failed: "+err.Error(), http.StatusInternalServerError)
-		return
+		return ""
+	}
+	pk := cache.PrimaryKey(table)
+	if len(pk) == 0 {
+		return ""
+	}
+	params := url.Values{}
+	for _, col := range pk {
+		if row[col] == nil {
+			return ""
+		}
+		params.Set(col, fmt.Sprintf("eq.%v", row[col]))
 	}
+	return "/" + table + "?" + params.Encode()
+}
+
+// scanRows reads every row into a column-name keyed map and closes rows
+func scanRows(rows pgx.Rows) []map[string]interface{} {
 	defer rows.Close()
 
-	// Process rows and write response.
 	fields := rows.FieldDescriptions()
 	var results []map[string]interface{}
 	for rows.Next() {
@@ -68,8 +267,5 @@ func HandleSelect(w http.ResponseWriter, r *http.Request) {
 
 		results = append(results, rowMap)
 	}
-	tx.Commit(ctx)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(results)
+	return results
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -17,6 +21,9 @@ import (
 func TestMain(m *testing.M) {
 	// Initialize database
 	initDB()
+	createFixtures()
+	// Requests without a token run as the login role of the test database
+	authConfig.AnonRole = "postgres"
 
 	// Run tests
 	code := m.Run()
@@ -29,13 +36,87 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// createFixtures creates the functions the RPC tests call and the tables without
+// upstream data that other tests seed, in the public tenant schema
+func createFixtures() {
+	_, err := DB.Exec(context.Background(), `
+		CREATE OR REPLACE FUNCTION public.test_add(a integer, b integer)
+			RETURNS integer LANGUAGE sql IMMUTABLE AS 'SELECT a + b';
+		CREATE OR REPLACE FUNCTION public.test_add(a integer, b integer, c integer)
+			RETURNS integer LANGUAGE sql IMMUTABLE AS 'SELECT a + b + c';
+		CREATE TABLE IF NOT EXISTS public.test_bookings (
+			id serial PRIMARY KEY,
+			during tstzrange NOT NULL
+		)`)
+	if err != nil {
+		// The DB-backed tests report the failure themselves
+		log.Println("Unable to create test fixtures:", err)
+	}
+}
+
 // Helper function to create a test router with the handler
 func createTestRouter() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(TenantMiddleware)
 	r.Get("/{table}", HandleSelect)
+	r.Post("/{table}", HandleInsert)
+	r.Patch("/{table}", HandleUpdate)
+	r.Delete("/{table}", HandleDelete)
+	r.Get("/rpc/{function}", HandleRPC)
+	r.Post("/rpc/{function}", HandleRPC)
 	return r
 }
 
+// seedAuthors inserts authors with the given first names and deletes them when the test ends
+func seedAuthors(t *testing.T, names ...string) {
+	t.Helper()
+	_, err := DB.Exec(context.Background(), "INSERT INTO public.authors (first_name) SELECT unnest($1::text[])", names)
+	if err != nil {
+		t.Fatalf("Failed to seed authors: %v", err)
+	}
+	cleanupAuthors(t, names...)
+}
+
+// cleanupAuthors deletes the authors with the given first names when the test ends
+func cleanupAuthors(t *testing.T, names ...string) {
+	t.Helper()
+	t.Cleanup(func() {
+		_, err := DB.Exec(context.Background(), "DELETE FROM public.authors WHERE first_name = ANY($1)", names)
+		if err != nil {
+			t.Errorf("Failed to clean up authors: %v", err)
+		}
+	})
+}
+
+// seedAuthor inserts one author and returns its id; it is deleted when the test ends
+func seedAuthor(t *testing.T, name string) int {
+	t.Helper()
+	var id int
+	err := DB.QueryRow(context.Background(), "INSERT INTO public.authors (first_name) VALUES ($1) RETURNING id", name).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to seed author: %v", err)
+	}
+	cleanupAuthors(t, name)
+	return id
+}
+
+// seedPost inserts a post by authorID and returns its id; it is deleted when the test
+// ends, before the author since cleanups run last-in first-out
+func seedPost(t *testing.T, authorID int, content string) int {
+	t.Helper()
+	var id int
+	err := DB.QueryRow(context.Background(), "INSERT INTO public.posts (author_id, content) VALUES ($1, $2) RETURNING id", authorID, content).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to seed post: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := DB.Exec(context.Background(), "DELETE FROM public.posts WHERE id = $1", id); err != nil {
+			t.Errorf("Failed to clean up post: %v", err)
+		}
+	})
+	return id
+}
+
 // TestLeftJoinBasic tests basic left join (default behavior)
 func TestLeftJoinBasic(t *testing.T) {
 	req := httptest.NewRequest("GET", "/authors?select=id,first_name,posts(id,content)", nil)
@@ -88,6 +169,11 @@ func TestInnerJoinBasic(t *testing.T) {
 		t.Logf("Inner join basic test passed. Got %d authors with posts", len(result))
 		t.Logf("Response sample: %v", result[0])
 	}
+	for _, author := range result {
+		if posts, _ := author["posts"].([]interface{}); len(posts) == 0 {
+			t.Errorf("Expected authors without posts to be filtered out, got: %v", author)
+		}
+	}
 }
 
 // TestMixedJoins tests mixed join types (inner join for posts, left join for stats)
@@ -284,6 +370,545 @@ func TestWithoutSelect(t *testing.T) {
 	t.Logf("Without select parameter test passed. Got %d authors", len(result))
 }
 
+// TestInsertReturnRepresentation tests that POST returns the inserted rows when asked to
+func TestInsertReturnRepresentation(t *testing.T) {
+	cleanupAuthors(t, "Insert Test")
+	body := strings.NewReader(`{"first_name":"Insert Test"}`)
+	req := httptest.NewRequest("POST", "/authors?select=id,first_name", body)
+	req.Header.Set("X-Tenant-ID", "public")
+	req.Header.Set("Prefer", "return=representation")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var result []map[string]interface{}
+	err := json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(result) != 1 || result[0]["first_name"] != "Insert Test" {
+		t.Errorf("Expected the inserted author back, got: %v", result)
+	}
+	if _, ok := result[0]["last_name"]; ok {
+		t.Errorf("Expected only selected columns, got: %v", result[0])
+	}
+}
+
+// TestInsertReturnMinimal tests that POST without a Prefer header returns an empty 201
+func TestInsertReturnMinimal(t *testing.T) {
+	cleanupAuthors(t, "Bulk One", "Bulk Two")
+	body := strings.NewReader(`[{"first_name":"Bulk One"},{"first_name":"Bulk Two"}]`)
+	req := httptest.NewRequest("POST", "/authors", body)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected status 201, got %d. Error: %s", w.Code, w.Body.String())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected empty body, got: %s", w.Body.String())
+	}
+}
+
+// TestInsertInvalidBody tests that a non-JSON body is rejected
+func TestInsertInvalidBody(t *testing.T) {
+	req := httptest.NewRequest("POST", "/authors", strings.NewReader(`"just a string"`))
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+// TestUpsertMergeDuplicates tests that POST with on_conflict updates an existing row
+func TestUpsertMergeDuplicates(t *testing.T) {
+	t.Cleanup(func() {
+		if _, err := DB.Exec(context.Background(), "DELETE FROM public.authors WHERE id = 900001"); err != nil {
+			t.Errorf("Failed to clean up author: %v", err)
+		}
+	})
+	router := createTestRouter()
+	for _, name := range []string{"Upsert Before", "Upsert After"} {
+		body := strings.NewReader(fmt.Sprintf(`{"id":900001,"first_name":%q}`, name))
+		req := httptest.NewRequest("POST", "/authors?on_conflict=id", body)
+		req.Header.Set("X-Tenant-ID", "public")
+		req.Header.Set("Prefer", "resolution=merge-duplicates,return=representation")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Error: %s", w.Code, w.Body.String())
+		}
+
+		var result []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(result) != 1 || result[0]["first_name"] != name {
+			t.Errorf("Expected first_name %q, got: %v", name, result)
+		}
+	}
+}
+
+// TestUpsertIgnoreDuplicates tests that POST with on_conflict skips a row that already exists
+func TestUpsertIgnoreDuplicates(t *testing.T) {
+	t.Cleanup(func() {
+		if _, err := DB.Exec(context.Background(), "DELETE FROM public.authors WHERE id = 900002"); err != nil {
+			t.Errorf("Failed to clean up author: %v", err)
+		}
+	})
+	router := createTestRouter()
+	for i, name := range []string{"Ignore First", "Ignore Second"} {
+		body := strings.NewReader(fmt.Sprintf(`{"id":900002,"first_name":%q}`, name))
+		req := httptest.NewRequest("POST", "/authors?on_conflict=id", body)
+		req.Header.Set("X-Tenant-ID", "public")
+		req.Header.Set("Prefer", "resolution=ignore-duplicates,return=representation")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d. Error: %s", w.Code, w.Body.String())
+		}
+
+		var result []map[string]interface{}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if want := 1 - i; len(result) != want {
+			t.Errorf("Expected %d inserted rows for %q, got: %v", want, name, result)
+		}
+	}
+}
+
+// TestUpdateRequiresFilter tests that a PATCH without filters is refused
+func TestUpdateRequiresFilter(t *testing.T) {
+	req := httptest.NewRequest("PATCH", "/authors", strings.NewReader(`{"first_name":"Everyone"}`))
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Error: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestUpdateReturnRepresentation tests that PATCH applies filters and returns the updated rows
+func TestUpdateReturnRepresentation(t *testing.T) {
+	seedAuthors(t, "Update Before")
+	cleanupAuthors(t, "Update After")
+
+	req := httptest.NewRequest("PATCH", "/authors?first_name=eq.Update%20Before&select=id,first_name", strings.NewReader(`{"first_name":"Update After"}`))
+	req.Header.Set("X-Tenant-ID", "public")
+	req.Header.Set("Prefer", "return=representation")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var result []map[string]interface{}
+	err := json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(result) == 0 {
+		t.Fatal("Expected the seeded author to be updated, got no rows")
+	}
+	for _, row := range result {
+		if row["first_name"] != "Update After" {
+			t.Errorf("Expected updated first_name, got: %v", row)
+		}
+	}
+	t.Logf("Update test passed. Updated %d authors", len(result))
+}
+
+// TestDeleteRequiresFilter tests that a DELETE without filters is refused
+func TestDeleteRequiresFilter(t *testing.T) {
+	req := httptest.NewRequest("DELETE", "/authors", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d. Error: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestDeleteWithCount tests that DELETE reports the number of deleted rows
+func TestDeleteWithCount(t *testing.T) {
+	seedAuthors(t, "Delete One", "Delete Two")
+
+	req := httptest.NewRequest("DELETE", "/authors?first_name=in.(Delete%20One,Delete%20Two)", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+	req.Header.Set("Prefer", "count=exact")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d. Error: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "*/2" {
+		t.Errorf("Expected Content-Range */2, got: %q", got)
+	}
+}
+
+// TestRPCUnknownFunction tests that calling a function missing from the tenant schema returns 404
+func TestRPCUnknownFunction(t *testing.T) {
+	req := httptest.NewRequest("POST", "/rpc/no_such_function", strings.NewReader(`{}`))
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d. Error: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestRPCScalar tests calling a scalar function of the tenant schema with query string arguments
+func TestRPCScalar(t *testing.T) {
+	req := httptest.NewRequest("GET", "/rpc/test_add?a=1&b=2", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var sum float64
+	if err := json.NewDecoder(w.Body).Decode(&sum); err != nil {
+		t.Fatalf("Expected a bare scalar, got %s: %v", w.Body.String(), err)
+	}
+	if sum != 3 {
+		t.Errorf("Expected 3, got %v", sum)
+	}
+}
+
+// TestRPCOverloads tests that GET resolves an overload against the query parameters sent
+// and that parameters a scalar function cannot use are rejected
+func TestRPCOverloads(t *testing.T) {
+	router := createTestRouter()
+	for query, want := range map[string]float64{"a=1&b=2": 3, "a=1&b=2&c=3": 6} {
+		req := httptest.NewRequest("GET", "/rpc/test_add?"+query, nil)
+		req.Header.Set("X-Tenant-ID", "public")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var sum float64
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&sum) != nil || sum != want {
+			t.Errorf("%s: expected %v, got %d: %v", query, want, w.Code, sum)
+		}
+	}
+
+	for query, code := range map[string]string{
+		"a=1&b=2&limit=1":  "invalid_limit",
+		"a=1&b=2&select=x": "invalid_select",
+		"a=1&b=2&d=eq.1":   "invalid_filter",
+		"a=1&a=5&b=2":      "invalid_filter",
+	} {
+		req := httptest.NewRequest("GET", "/rpc/test_add?"+query, nil)
+		req.Header.Set("X-Tenant-ID", "public")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), code) {
+			t.Errorf("%s: expected 400 %s, got %d: %s", query, code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestSelectRangeFilters tests the range operators against a tstzrange column
+func TestSelectRangeFilters(t *testing.T) {
+	var id int
+	err := DB.QueryRow(context.Background(),
+		`INSERT INTO public.test_bookings (during) VALUES ('[2024-01-01 10:00Z,2024-01-01 12:00Z)') RETURNING id`).Scan(&id)
+	if err != nil {
+		t.Fatalf("Failed to seed bookings: %v", err)
+	}
+	t.Cleanup(func() {
+		DB.Exec(context.Background(), "DELETE FROM public.test_bookings WHERE id = $1", id)
+	})
+
+	router := createTestRouter()
+	for filter, want := range map[string]int{
+		`ov.["2024-01-01 11:00Z","2024-01-01 13:00Z")`:  1,
+		`adj.["2024-01-01 12:00Z","2024-01-01 14:00Z")`: 1,
+		`sl.["2024-01-01 12:00Z","2024-01-01 14:00Z")`:  1,
+		`cs.["2024-01-01 09:00Z","2024-01-01 13:00Z")`:  0,
+		`cd.["2024-01-01 09:00Z","2024-01-01 13:00Z")`:  1,
+	} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/test_bookings?id=eq.%d&during=%s", id, url.QueryEscape(filter)), nil)
+		req.Header.Set("X-Tenant-ID", "public")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var rows []map[string]any
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&rows) != nil || len(rows) != want {
+			t.Errorf("%s: expected %d rows, got %d: %v", filter, want, w.Code, rows)
+		}
+	}
+}
+
+// TestUnknownTenant tests that a tenant without a schema is rejected before the search_path is set
+func TestUnknownTenant(t *testing.T) {
+	for _, tenant := range []string{"no_such_tenant", `public"; DROP TABLE authors; --`} {
+		req := httptest.NewRequest("GET", "/authors", nil)
+		req.Header.Set("X-Tenant-ID", tenant)
+
+		w := httptest.NewRecorder()
+		router := createTestRouter()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%q: expected status 404, got %d. Error: %s", tenant, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestInvalidToken tests that a bearer token failing verification is rejected with 401
+func TestInvalidToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "/authors", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+	req.Header.Set("Authorization", "Bearer not-a-token")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d. Error: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestPreRequestHook tests that the hook runs for reads, writes and RPC and that its error is reported
+func TestPreRequestHook(t *testing.T) {
+	defer func(saved string) { preRequestFunction = saved }(preRequestFunction)
+	preRequestFunction = "no_such_pre_request_hook"
+
+	router := createTestRouter()
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/authors", nil),
+		httptest.NewRequest("POST", "/authors", strings.NewReader(`{"first_name":"Hooked"}`)),
+		httptest.NewRequest("POST", "/rpc/test_add", strings.NewReader(`{"a":1,"b":2}`)),
+	} {
+		req.Header.Set("X-Tenant-ID", "public")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// The missing hook function surfaces as undefined_function
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "42883") {
+			t.Errorf("%s %s: expected the hook error, got %d: %s", req.Method, req.URL.Path, w.Code, w.Body.String())
+		}
+	}
+}
+
+// TestSelectFilterOperators tests negated and wildcard filters against the database
+func TestSelectFilterOperators(t *testing.T) {
+	seedAuthors(t, "FltrTestBob", "FltrTestRob", "FltrTestAnn")
+
+	req := httptest.NewRequest("GET", "/authors?select=first_name&first_name=like.FltrTest*&first_name=ilike.*o*&first_name=not.eq.FltrTestRob&id=not.is.null", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []map[string]interface{}{{"first_name": "FltrTestBob"}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected %v, got: %v", want, results)
+	}
+}
+
+// TestSelectEmbedFilters tests that dotted params filter and limit the embedded rows only
+func TestSelectEmbedFilters(t *testing.T) {
+	authorID := seedAuthor(t, "EmbedFiltersAuthor")
+	seedPost(t, authorID, "go one")
+	latest := seedPost(t, authorID, "go two")
+	seedPost(t, authorID, "rust")
+
+	target := fmt.Sprintf("/authors?select=id,posts(id,content)&id=eq.%d&posts.content=ilike.*o*&posts.order=id.desc&posts.limit=1", authorID)
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"id":    float64(authorID),
+		"posts": []interface{}{map[string]interface{}{"id": float64(latest), "content": "go two"}},
+	}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected %v, got: %v", want, results)
+	}
+}
+
+// TestSelectManyToOneColumns tests that a many-to-one embed returns only the selected columns
+func TestSelectManyToOneColumns(t *testing.T) {
+	authorID := seedAuthor(t, "ManyToOneAuthor")
+	postID := seedPost(t, authorID, "many to one")
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/posts?select=id,authors!author_id(first_name)&id=eq.%d", postID), nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"id":      float64(postID),
+		"authors": map[string]interface{}{"first_name": "ManyToOneAuthor"},
+	}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected %v, got: %v", want, results)
+	}
+}
+
+// TestSelectEmbedAliases tests that aliased columns and embeds come back under their aliases
+func TestSelectEmbedAliases(t *testing.T) {
+	authorID := seedAuthor(t, "AliasAuthor")
+	postID := seedPost(t, authorID, "aliased")
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/authors?select=firstName:first_name,id::text,writings:posts(postId:id)&id=eq.%d", authorID), nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var results []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := []map[string]interface{}{{
+		"firstName": "AliasAuthor",
+		"id":        fmt.Sprint(authorID),
+		"writings":  []interface{}{map[string]interface{}{"postId": float64(postID)}},
+	}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("Expected %v, got: %v", want, results)
+	}
+}
+
+// TestSelectBadOperator tests that an unknown filter operator is rejected with a JSON error
+func TestSelectBadOperator(t *testing.T) {
+	req := httptest.NewRequest("GET", "/authors?id=equals.1", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected a JSON error body: %v", err)
+	}
+	if body["code"] != "bad_operator" {
+		t.Errorf("Expected code bad_operator, got: %v", body)
+	}
+}
+
+// TestSelectUnknownTable tests that a table missing from the tenant schema is reported as 404
+func TestSelectUnknownTable(t *testing.T) {
+	req := httptest.NewRequest("GET", "/no_such_table", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+
+	w := httptest.NewRecorder()
+	router := createTestRouter()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d. Error: %s", w.Code, w.Body.String())
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected a JSON error body: %v", err)
+	}
+	if body["code"] != "table_not_found" {
+		t.Errorf("Expected code table_not_found, got: %v", body)
+	}
+}
+
+// TestSchemaQualifiedTable tests that a table name cannot name a schema other than the tenant's
+func TestSchemaQualifiedTable(t *testing.T) {
+	router := createTestRouter()
+	for _, path := range []string{"/public.authors?id=eq.-1", "/pg_catalog.pg_roles?oid=eq.-1"} {
+		for _, method := range []string{"GET", "DELETE"} {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-Tenant-ID", "public")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "table_not_found") {
+				t.Errorf("%s %s: expected 404 table_not_found, got %d: %s", method, path, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
 // IntegrationTestAllEndpoints runs all tests and prints summary
 func TestIntegrationAllEndpoints(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AuthConfig holds how bearer tokens are verified and mapped to database roles
+type AuthConfig struct {
+	Secret    []byte         // HS256 key (JWT_SECRET)
+	Keys      map[string]any // public or shared keys by kid, from the JWKS file in JWT_JWKS_FILE
+	RoleClaim string         // claim naming the database role (JWT_ROLE_CLAIM, default role)
+	AnonRole  string         // role for requests without a token (DB_ANON_ROLE); empty requires a token with a role
+}
+
+// authConfig is replaced by main from the environment
+var authConfig = AuthConfig{RoleClaim: "role"}
+
+// loadAuthConfig reads the JWT and role settings from configuration
+func loadAuthConfig(getenv func(string) string) (AuthConfig, error) {
+	cfg := AuthConfig{
+		Secret:    []byte(getenv("JWT_SECRET")),
+		RoleClaim: getenv("JWT_ROLE_CLAIM"),
+		AnonRole:  getenv("DB_ANON_ROLE"),
+	}
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	if path := getenv("JWT_JWKS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if cfg.Keys, err = parseJWKS(data); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// jwk is a single key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS decodes the RSA, EC and oct keys of a JWKS document into verification keys
+func parseJWKS(data []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("JWKS contains no keys")
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("duplicate kid %q in JWKS", k.Kid)
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes the key material of k
+func (k jwk) publicKey() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return decode(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// errInvalidToken is wrapped by every bearer token that fails verification
+var errInvalidToken = errors.New("invalid token")
+
+// errAnonDisabled is returned for a request without a role when no DB_ANON_ROLE is
+// configured, so it never runs as the connection's own role
+var errAnonDisabled = errors.New("anonymous access is disabled: send a bearer token with a role claim or configure DB_ANON_ROLE")
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header, or ""
+func bearerToken(r *http.Request) string {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// verificationKey picks the key a token is checked with: the JWKS key named by its
+// kid, the only JWKS key, or the HS256 secret. The parser rejects a key that does
+// not fit the token's algorithm, so an HMAC token cannot be checked with a public key.
+func (c AuthConfig) verificationKey(t *jwt.Token) (any, error) {
+	if kid, _ := t.Header["kid"].(string); kid != "" {
+		if key, ok := c.Keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok && len(c.Secret) > 0 {
+		return c.Secret, nil
+	}
+	if len(c.Keys) == 1 {
+		for _, key := range c.Keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("no key to verify the token with")
+}
+
+// verifyJWT checks the signature and time claims of token and returns its claims
+func verifyJWT(token string) (jwt.MapClaims, error) {
+	if len(authConfig.Secret) == 0 && len(authConfig.Keys) == 0 {
+		return nil, fmt.Errorf("%w: no JWT_SECRET or JWT_JWKS_FILE is configured", errInvalidToken)
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, authConfig.verificationKey, jwt.WithValidMethods([]string{
+		"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512",
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return claims, nil
+}
+
+// authenticate verifies the bearer token of r, if any, and returns the database role
+// to run the request as together with the claims to expose to SQL. Requests without
+// a token, or tokens without a role claim, run as the anon role, and are refused
+// when there is none.
+func authenticate(r *http.Request) (string, jwt.MapClaims, error) {
+	token := bearerToken(r)
+	if token == "" {
+		if authConfig.AnonRole == "" {
+			return "", nil, errAnonDisabled
+		}
+		return authConfig.AnonRole, jwt.MapClaims{authConfig.RoleClaim: authConfig.AnonRole}, nil
+	}
+
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return "", nil, err
+	}
+	role, _ := claims[authConfig.RoleClaim].(string)
+	if role == "" {
+		if authConfig.AnonRole == "" {
+			return "", nil, errAnonDisabled
+		}
+		role = authConfig.AnonRole
+	}
+	return role, claims, nil
+}
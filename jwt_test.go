@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestVerifyJWTWithJWKS tests RS256 verification against a JWKS document
+func TestVerifyJWTWithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"k1","n":%q,"e":%q}]}`,
+		enc(key.N.Bytes()), enc(big.NewInt(int64(key.E)).Bytes()))
+	keys, err := parseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	defer func(saved AuthConfig) { authConfig = saved }(authConfig)
+	authConfig = AuthConfig{Keys: keys, RoleClaim: "role"}
+
+	sign := func(kid string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s
+	}
+
+	claims, err := verifyJWT(sign("k1", jwt.MapClaims{"role": "editor"}))
+	if err != nil || claims["role"] != "editor" {
+		t.Errorf("Expected a verified editor token, got %v (%v)", claims, err)
+	}
+
+	expired := sign("k1", jwt.MapClaims{"role": "editor", "exp": time.Now().Add(-time.Hour).Unix()})
+	unknownKid := sign("k2", jwt.MapClaims{"role": "editor"})
+	// An HMAC token signed with the public modulus must not verify against the RSA key
+	hmacConfusion, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"role": "admin"}).SignedString(key.N.Bytes())
+	for name, token := range map[string]string{"expired": expired, "unknown kid": unknownKid, "hmac": hmacConfusion, "garbage": "a.b.c"} {
+		if _, err := verifyJWT(token); !errors.Is(err, errInvalidToken) {
+			t.Errorf("%s: expected errInvalidToken, got: %v", name, err)
+		}
+	}
+}
+
+// TestAuthenticate tests the role picked for anonymous and authenticated requests
+func TestAuthenticate(t *testing.T) {
+	defer func(saved AuthConfig) { authConfig = saved }(authConfig)
+	authConfig = AuthConfig{Secret: []byte("test-secret"), RoleClaim: "role", AnonRole: "web_anon"}
+
+	req := httptest.NewRequest("GET", "/authors", nil)
+	role, claims, err := authenticate(req)
+	if err != nil || role != "web_anon" || claims["role"] != "web_anon" {
+		t.Errorf("Expected the anon role, got %q %v (%v)", role, claims, err)
+	}
+
+	for tokenClaims, want := range map[string]string{"editor": "editor", "": "web_anon"} {
+		c := jwt.MapClaims{"sub": "42"}
+		if tokenClaims != "" {
+			c["role"] = tokenClaims
+		}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(authConfig.Secret)
+		req := httptest.NewRequest("GET", "/authors", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		role, claims, err := authenticate(req)
+		if err != nil || role != want || claims["sub"] != "42" {
+			t.Errorf("Expected role %q, got %q %v (%v)", want, role, claims, err)
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	if _, _, err := authenticate(req); !errors.Is(err, errInvalidToken) {
+		t.Errorf("Expected errInvalidToken, got: %v", err)
+	}
+}
+
+// TestAuthenticateWithoutAnonRole tests that requests without a role are refused when no anon role is configured
+func TestAuthenticateWithoutAnonRole(t *testing.T) {
+	defer func(saved AuthConfig) { authConfig = saved }(authConfig)
+	authConfig = AuthConfig{Secret: []byte("test-secret"), RoleClaim: "role"}
+
+	req := httptest.NewRequest("GET", "/authors", nil)
+	if _, _, err := authenticate(req); !errors.Is(err, errAnonDisabled) {
+		t.Errorf("Expected errAnonDisabled without a token, got: %v", err)
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "42"}).SignedString(authConfig.Secret)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, _, err := authenticate(req); !errors.Is(err, errAnonDisabled) {
+		t.Errorf("Expected errAnonDisabled for a token without a role, got: %v", err)
+	}
+
+	token, _ = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"role": "editor"}).SignedString(authConfig.Secret)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if role, _, err := authenticate(req); err != nil || role != "editor" {
+		t.Errorf("Expected role editor, got %q (%v)", role, err)
+	}
+}
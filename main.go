@@ -1,12 +1,27 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
 )
 
 func main() {
+	resolvers, err := loadTenantResolvers(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid tenant configuration: %v", err)
+	}
+	tenantResolvers = resolvers
+
+	if authConfig, err = loadAuthConfig(os.Getenv); err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+	preRequestFunction = os.Getenv("DB_PRE_REQUEST")
+
 	initDB()
+	go listenForSchemaReload(context.Background(), DB.Config().ConnConfig)
+
 	r := NewRouter()
 	log.Println("Server running on :8080")
 	http.ListenAndServe(":8080", r)
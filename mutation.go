@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgx/v5"
+)
+
+// sourceAlias names the CTE that holds the rows touched by a write so the
+// select= columns (and embeds) can be rendered on top of them
+const sourceAlias = "pgrst_source"
+
+// Payload is a write request body normalized into a JSON array of objects
+type Payload struct {
+	JSON    []byte
+	Columns []string // sorted union of keys across all rows
+	Rows    int
+}
+
+// parsePayload normalizes a JSON object or array of objects into a Payload
+func parsePayload(body []byte) (Payload, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return Payload{}, errors.New("request body is empty")
+	}
+
+	var rows []map[string]json.RawMessage
+	switch body[0] {
+	case '{':
+		var row map[string]json.RawMessage
+		if err := json.Unmarshal(body, &row); err != nil {
+			return Payload{}, err
+		}
+		rows = append(rows, row)
+	case '[':
+		if err := json.Unmarshal(body, &rows); err != nil {
+			return Payload{}, err
+		}
+	default:
+		return Payload{}, errors.New("request body must be a JSON object or an array of objects")
+	}
+	if len(rows) == 0 {
+		return Payload{}, errors.New("request body contains no rows")
+	}
+
+	seen := make(map[string]bool)
+	var columns []string
+	for _, row := range rows {
+		for key := range row {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return Payload{}, errors.New("request body contains no columns")
+	}
+	sort.Strings(columns)
+
+	payload, err := json.Marshal(rows)
+	if err != nil {
+		return Payload{}, err
+	}
+	return Payload{JSON: payload, Columns: columns, Rows: len(rows)}, nil
+}
+
+// payloadColumns restricts the payload keys to the ones listed in columns=, if present
+func payloadColumns(params url.Values, columns []string) []string {
+	specified := params.Get("columns")
+	if specified == "" {
+		return columns
+	}
+	var cols []string
+	for _, c := range strings.Split(specified, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// errMissingFilters is returned when a PATCH or DELETE has no filters and the caller did not opt in
+var errMissingFilters = errors.New("filters are required; send Prefer: allow-unfiltered to affect every row")
+
+// pagingParamCodes maps the paging params to the code they are rejected with where they do not apply
+var pagingParamCodes = map[string]string{"order": "invalid_order", "limit": "invalid_limit", "offset": "invalid_offset"}
+
+// checkWriteParams rejects params a write would otherwise ignore: writes do not
+// filter or page embedded resources (posts.id=eq.1), and they always affect every
+// matching row, so order, limit and offset are refused rather than dropped
+func checkWriteParams(params url.Values) error {
+	for key := range params {
+		if code, ok := pagingParamCodes[key]; ok {
+			return &QueryError{
+				Code:    code,
+				Param:   key,
+				Message: fmt.Sprintf("'%s' is not supported on writes, which affect every row matching the filters", key),
+			}
+		}
+		if strings.Contains(key, ".") && !logicOperators[key] {
+			return &QueryError{
+				Code:    "unknown_embed",
+				Param:   key,
+				Message: fmt.Sprintf("'%s' addresses an embedded resource, which writes do not filter", key),
+			}
+		}
+	}
+	return nil
+}
+
+// bodyAlias names the row source created from the request payload
+const bodyAlias = "pgrst_body"
+
+// payloadSource reads the payload rows as records of the table's row type
+func payloadSource(table string, payload Payload) exp.AliasedExpression {
+	return goqu.L("json_populate_recordset(NULL::?, ?)", goqu.T(table), string(payload.JSON)).As(bodyAlias)
+}
+
+// returningQuery renders the select= columns over the rows returned by a write.
+// headers-only responses only need the raw row, so select= is ignored for them.
+func returningQuery(ctx context.Context, db Querier, table string, params url.Values, prefs Preferences, write exp.Expression) (SQLQuery, error) {
+	var items []SelectItem
+	if prefs.Return != "headers-only" {
+		var err error
+		if items, err = ParseSelect(params.Get("select")); err != nil {
+			return SQLQuery{}, err
+		}
+	}
+
+	def, err := lookupTable(ctx, db, table)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if err := checkSelectColumns(def, items); err != nil {
+		return SQLQuery{}, err
+	}
+	selectCols, err := buildSelectColumns(ctx, db, table, items, params)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+
+	dialect := goqu.Dialect("postgres")
+	query := dialect.From(goqu.T(sourceAlias).As(goqu.T(table))).
+		With(sourceAlias, write).
+		Select(selectCols...)
+
+	sql, values, err := query.Prepared(true).ToSQL()
+	return SQLQuery{Query: sql, Values: values}, err
+}
+
+// BuildInsert builds an INSERT that reads its rows from the JSON payload with
+// json_populate_recordset, so every value is sent as a single bound parameter.
+// When the client wants the rows back they are shaped by the select= parameter.
+func BuildInsert(ctx context.Context, db Querier, table string, params url.Values, payload Payload, prefs Preferences) (SQLQuery, error) {
+	if err := checkWriteParams(params); err != nil {
+		return SQLQuery{}, err
+	}
+	if _, err := lookupTable(ctx, db, table); err != nil {
+		return SQLQuery{}, err
+	}
+	columns := payloadColumns(params, payload.Columns)
+
+	dialect := goqu.Dialect("postgres")
+	cols := make([]any, len(columns))
+	for i, c := range columns {
+		cols[i] = goqu.C(c)
+	}
+
+	target, set, err := onConflict(ctx, db, table, params, columns, prefs)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	from := exp.Expression(payloadSource(table, payload))
+	if target != "" && len(set) == 0 {
+		// goqu only writes a conflict target for DO UPDATE, so the DO NOTHING
+		// clause trails the payload source, which ends the INSERT
+		from = goqu.L("? ON CONFLICT (?) DO NOTHING", from, goqu.L(target))
+	}
+
+	source := dialect.From(from).Select(cols...)
+	insert := dialect.Insert(goqu.T(table)).Cols(cols...).FromQuery(source)
+	if target != "" && len(set) > 0 {
+		insert = insert.OnConflict(goqu.DoUpdate(target, set))
+	}
+
+	if !prefs.Returning() {
+		sql, values, err := insert.Prepared(true).ToSQL()
+		return SQLQuery{Query: sql, Values: values}, err
+	}
+	return returningQuery(ctx, db, table, params, prefs, insert.Returning(goqu.Star()))
+}
+
+// onConflict reads Prefer: resolution into an ON CONFLICT target and the columns
+// to merge. The target comes from on_conflict= and defaults to the table's primary
+// key; it is empty when the insert is not an upsert, and an empty set means DO NOTHING.
+func onConflict(ctx context.Context, db Querier, table string, params url.Values, columns []string, prefs Preferences) (string, goqu.Record, error) {
+	if prefs.Resolution != "merge-duplicates" && prefs.Resolution != "ignore-duplicates" {
+		return "", nil, nil
+	}
+
+	var targetCols []string
+	if s := params.Get("on_conflict"); s != "" {
+		targetCols = strings.Split(s, ",")
+	} else {
+		cache, err := getSchemaCache(ctx, db)
+		if err != nil {
+			return "", nil, err
+		}
+		if targetCols = cache.PrimaryKey(table); len(targetCols) == 0 {
+			return "", nil, fmt.Errorf("table '%s' has no primary key; pass on_conflict to resolve duplicates", table)
+		}
+	}
+	isTarget := make(map[string]bool, len(targetCols))
+	target := make([]string, len(targetCols))
+	for i, c := range targetCols {
+		c = strings.TrimSpace(c)
+		isTarget[c] = true
+		// goqu writes the target verbatim, so quote each column ourselves
+		target[i] = pgx.Identifier{c}.Sanitize()
+	}
+
+	set := goqu.Record{}
+	if prefs.Resolution == "merge-duplicates" {
+		// When every payload column is part of the key there is nothing to merge
+		for _, c := range columns {
+			if !isTarget[c] {
+				set[c] = goqu.L("EXCLUDED.?", goqu.I(c))
+			}
+		}
+	}
+	return strings.Join(target, ","), set, nil
+}
+
+// BuildUpdate builds an UPDATE that sets the payload columns on every row matching
+// the column filters in params. The payload must hold a single object.
+func BuildUpdate(ctx context.Context, db Querier, table string, params url.Values, payload Payload, prefs Preferences) (SQLQuery, error) {
+	if err := checkWriteParams(params); err != nil {
+		return SQLQuery{}, err
+	}
+	def, err := lookupTable(ctx, db, table)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	filters, err := buildFilters(table, def, params)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if len(filters) == 0 && !prefs.AllowUnfiltered {
+		return SQLQuery{}, errMissingFilters
+	}
+
+	set := goqu.Record{}
+	for _, c := range payloadColumns(params, payload.Columns) {
+		set[c] = goqu.T(bodyAlias).Col(c)
+	}
+
+	dialect := goqu.Dialect("postgres")
+	update := dialect.Update(goqu.T(table)).Set(set).From(payloadSource(table, payload))
+	if len(filters) > 0 {
+		update = update.Where(filters...)
+	}
+
+	if !prefs.Returning() {
+		sql, values, err := update.Prepared(true).ToSQL()
+		return SQLQuery{Query: sql, Values: values}, err
+	}
+	return returningQuery(ctx, db, table, params, prefs, update.Returning(goqu.T(table).All()))
+}
+
+// BuildDelete builds a DELETE of every row matching the column filters in params
+func BuildDelete(ctx context.Context, db Querier, table string, params url.Values, prefs Preferences) (SQLQuery, error) {
+	if err := checkWriteParams(params); err != nil {
+		return SQLQuery{}, err
+	}
+	def, err := lookupTable(ctx, db, table)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	filters, err := buildFilters(table, def, params)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if len(filters) == 0 && !prefs.AllowUnfiltered {
+		return SQLQuery{}, errMissingFilters
+	}
+
+	dialect := goqu.Dialect("postgres")
+	del := dialect.Delete(goqu.T(table))
+	if len(filters) > 0 {
+		del = del.Where(filters...)
+	}
+
+	if !prefs.Returning() {
+		sql, values, err := del.Prepared(true).ToSQL()
+		return SQLQuery{Query: sql, Values: values}, err
+	}
+	return returningQuery(ctx, db, table, params, prefs, del.Returning(goqu.T(table).All()))
+}
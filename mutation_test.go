@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParsePayload tests that objects and arrays are normalized into one JSON array
+func TestParsePayload(t *testing.T) {
+	payload, err := parsePayload([]byte(`{"b":1,"a":"x"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(payload.JSON) != `[{"a":"x","b":1}]` {
+		t.Errorf("Unexpected payload: %s", payload.JSON)
+	}
+	if !reflect.DeepEqual(payload.Columns, []string{"a", "b"}) {
+		t.Errorf("Unexpected columns: %v", payload.Columns)
+	}
+
+	payload, err = parsePayload([]byte(`[{"a":1},{"c":2}]`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(payload.Columns, []string{"a", "c"}) {
+		t.Errorf("Expected union of keys, got: %v", payload.Columns)
+	}
+
+	for _, body := range []string{``, `[]`, `42`, `[{}]`} {
+		if _, err := parsePayload([]byte(body)); err == nil {
+			t.Errorf("Expected error for body %q", body)
+		}
+	}
+}
+
+// TestBuildInsertUpsert tests that Prefer: resolution adds the matching ON CONFLICT clause
+func TestBuildInsertUpsert(t *testing.T) {
+	payload, err := parsePayload([]byte(`{"email":"a@example.com","name":"A"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	params := url.Values{"on_conflict": {"email"}}
+
+	sql, err := BuildInsert(testContext(), nil, "users", params, payload, Preferences{Resolution: "merge-duplicates"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(sql.Query, `ON CONFLICT ("email") DO UPDATE SET "name"=EXCLUDED."name"`) {
+		t.Errorf("Expected merge clause, got: %s", sql.Query)
+	}
+
+	sql, err = BuildInsert(testContext(), nil, "users", params, payload, Preferences{Resolution: "ignore-duplicates"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(sql.Query, `AS "pgrst_body" ON CONFLICT ("email") DO NOTHING`) {
+		t.Errorf("Expected DO NOTHING clause on email, got: %s", sql.Query)
+	}
+
+	sql, err = BuildInsert(testContext(), nil, "users", url.Values{"on_conflict": {"email,name"}}, payload, Preferences{Resolution: "merge-duplicates"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasSuffix(sql.Query, `ON CONFLICT ("email","name") DO NOTHING`) {
+		t.Errorf("Expected DO NOTHING clause when every column is in the key, got: %s", sql.Query)
+	}
+
+	sql, err = BuildInsert(testContext(), nil, "users", params, payload, Preferences{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Contains(sql.Query, "ON CONFLICT") {
+		t.Errorf("Expected a plain insert, got: %s", sql.Query)
+	}
+}
+
+// TestBuildMutationFilters tests that writes reject params a read would take as join or embed configuration
+func TestBuildMutationFilters(t *testing.T) {
+	payload, err := parsePayload([]byte(`{"first_name":"A"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, query := range []string{"nmae=eqq.x", "posts=author_id.id", "posts(id)=eq.1", "posts.id=eq.1", "select=id,posts(id)&posts.limit=1",
+		"id=gt.1&limit=1", "id=gt.1&order=id", "id=gt.1&offset=1"} {
+		params, _ := url.ParseQuery(query)
+		_, updateErr := BuildUpdate(testContext(), nil, "authors", params, payload, Preferences{})
+		_, deleteErr := BuildDelete(testContext(), nil, "authors", params, Preferences{})
+		for _, err := range []error{updateErr, deleteErr} {
+			var queryErr *QueryError
+			if !errors.As(err, &queryErr) {
+				t.Errorf("%s: expected a QueryError, got: %v", query, err)
+			}
+		}
+	}
+
+	// Writes affect every matching row, so paging params are refused
+	params, _ := url.ParseQuery("id=gt.1&limit=1")
+	_, err = BuildInsert(testContext(), nil, "authors", params, payload, Preferences{})
+	var queryErr *QueryError
+	if !errors.As(err, &queryErr) || queryErr.Code != "invalid_limit" || queryErr.Param != "limit" {
+		t.Errorf("Expected invalid_limit for an insert, got: %v", err)
+	}
+}
+
+// TestBuildMutationTable tests that writes only reach tables of the tenant schema
+func TestBuildMutationTable(t *testing.T) {
+	payload, err := parsePayload([]byte(`{"first_name":"A"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	prefs := Preferences{AllowUnfiltered: true}
+
+	for _, table := range []string{"other_tenant.authors", "no_such_table"} {
+		_, insertErr := BuildInsert(testContext(), nil, table, url.Values{}, payload, prefs)
+		_, updateErr := BuildUpdate(testContext(), nil, table, url.Values{}, payload, prefs)
+		_, deleteErr := BuildDelete(testContext(), nil, table, url.Values{}, prefs)
+		for _, err := range []error{insertErr, updateErr, deleteErr} {
+			if !errors.Is(err, errTableNotFound) {
+				t.Errorf("%s: expected errTableNotFound, got: %v", table, err)
+			}
+		}
+	}
+
+	sql, err := BuildDelete(testContext(), nil, "authors", url.Values{}, prefs)
+	if err != nil || sql.Query != `DELETE FROM "authors"` {
+		t.Errorf("Unexpected delete %q (%v)", sql.Query, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Preferences holds the options a client asked for through the Prefer header
+type Preferences struct {
+	Return          string // minimal, headers-only or representation
+	Count           string // exact reports the number of affected rows in Content-Range
+	Resolution      string // merge-duplicates or ignore-duplicates turns an insert into an upsert
+	AllowUnfiltered bool   // allow-unfiltered lets PATCH and DELETE touch every row
+}
+
+// Returning reports whether the written rows have to be read back
+func (p Preferences) Returning() bool {
+	return p.Return == "representation" || p.Return == "headers-only"
+}
+
+// parsePrefer reads the comma-separated key=value pairs of every Prefer header on the request
+func parsePrefer(r *http.Request) Preferences {
+	var prefs Preferences
+	for _, header := range r.Header.Values("Prefer") {
+		for _, item := range strings.Split(header, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+			switch strings.TrimSpace(key) {
+			case "return":
+				prefs.Return = strings.TrimSpace(value)
+			case "resolution":
+				prefs.Resolution = strings.TrimSpace(value)
+			case "count":
+				prefs.Count = strings.TrimSpace(value)
+			case "allow-unfiltered":
+				prefs.AllowUnfiltered = true
+			}
+		}
+	}
+	return prefs
+}
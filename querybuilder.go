@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/doug-martin/goqu/v9"
 	_ "github.com/doug-martin/goqu/v9/dialect/postgres"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -19,6 +21,7 @@ type SQLQuery struct {
 }
 
 type Querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
 	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
@@ -34,192 +37,624 @@ type JoinConfig struct {
 	Offset  int
 }
 
-func BuildQuery(ctx context.Context, db Querier, table string, params url.Values) SQLQuery {
-	dialect := goqu.Dialect("postgres")
-	query := dialect.From(table)
-
-	// Handle SELECT columns (support nested embedding like directors(id,last_name))
-	if s := params.Get("select"); s != "" {
-		// Parse comma-separated fields but keep parentheses groups together
-		fields := splitSelectFields(s)
-		selectCols := make([]any, 0, len(fields))
-		for _, f := range fields {
-			f = strings.TrimSpace(f)
-			// nested like: related_table(col1,col2) or related_table!inner(col1,col2)
-			if strings.Contains(f, "(") && strings.Contains(f, ")") {
-				// extract table, join type, and columns
-				re := regexp.MustCompile(`^(\w+)(!inner)?\((.*)\)$`)
-				m := re.FindStringSubmatch(f)
-				if len(m) == 4 {
-					relTable := m[1]
-					joinTypeMarker := m[2] // "!inner" or ""
-					colsStr := m[3]
-					useInnerJoin := joinTypeMarker == "!inner"
-
-					// Determine relationship type
-					mainSingular := singularize(table)
-					relSingular := singularize(relTable)
-
-					// Pattern 1: Many-to-one - main_table.{related_table_singular}_id = related_table.id
-					// Pattern 2: One-to-many - related_table.{main_table_singular}_id = main_table.id
-					manyToOneFK := fmt.Sprintf("%s_%s", relSingular, "id")  // e.g., "author_id"
-					oneToManyFK := fmt.Sprintf("%s_%s", mainSingular, "id") // e.g., "post_id"
-
-					// Check which foreign key exists to determine relationship type
-					isManyToOne := columnExists(ctx, db, table, manyToOneFK)
-
-					// Recursively build the nested select columns
-					nestedSelectSQL := buildNestedSelect(ctx, db, relTable, colsStr, mainSingular)
-
-					var sub string
-					if isManyToOne {
-						// Many-to-one relationship: main_table.{related_table_singular}_id = related_table.id
-						// Return a single JSON object (not an array)
-						sub = fmt.Sprintf(
-							"(SELECT row_to_json(%s.*) FROM %s WHERE %s.id = %s.%s LIMIT 1) AS %s",
-							relTable, relTable, relTable, table, manyToOneFK, relTable,
-						)
-					} else {
-						// One-to-many relationship: related_table.{main_table_singular}_id = main_table.id
-						// Return an array of JSON objects
-						if useInnerJoin {
-							// INNER JOIN: only include if related rows exist (no COALESCE to array)
-							sub = fmt.Sprintf(
-								"(SELECT json_agg(row_to_json(arr)) FROM (SELECT %s FROM %s WHERE %s.%s = %s.id) arr) AS %s",
-								nestedSelectSQL, relTable, relTable, oneToManyFK, table, relTable,
-							)
-						} else {
-							// LEFT JOIN: include all rows, with empty array for no matches
-							sub = fmt.Sprintf(
-								"(SELECT COALESCE(json_agg(row_to_json(arr)), '[]'::json) FROM (SELECT %s FROM %s WHERE %s.%s = %s.id) arr) AS %s",
-								nestedSelectSQL, relTable, relTable, oneToManyFK, table, relTable,
-							)
-						}
-					}
-
-					selectCols = append(selectCols, goqu.L(sub))
-					continue
-				}
-			}
+func BuildQuery(ctx context.Context, db Querier, table string, params url.Values) (SQLQuery, error) {
+	items, err := ParseSelect(params.Get("select"))
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if err := checkEmbedParams(items, params); err != nil {
+		return SQLQuery{}, err
+	}
+	def, err := lookupTable(ctx, db, table)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if err := checkSelectColumns(def, items); err != nil {
+		return SQLQuery{}, err
+	}
+	selectCols, err := buildSelectColumns(ctx, db, table, items, params)
+	if err != nil {
+		return SQLQuery{}, err
+	}
 
-			// regular column
-			selectCols = append(selectCols, goqu.C(f))
-		}
+	dialect := goqu.Dialect("postgres")
+	query := dialect.From(goqu.T(table)).Select(selectCols...)
 
-		if len(selectCols) > 0 {
-			query = query.Select(selectCols...)
-		} else {
-			query = query.Select("*")
-		}
-	} else {
-		query = query.Select("*")
+	// Legacy join params name another table of the schema; the rest are filters
+	cache, err := getSchemaCache(ctx, db)
+	if err != nil {
+		return SQLQuery{}, err
 	}
+	filterParams, joinParams := splitJoinParams(cache, def, params)
 
 	// Handle WHERE conditions for main table
-	for key, val := range params {
-		if key == "select" || key == "order" || key == "limit" || key == "offset" || strings.Contains(key, ".") {
-			continue
-		}
-		// Skip if this is a related resource (contains parentheses or is a table reference)
-		if strings.Contains(key, "(") || isRelatedResource(key, params) {
-			continue
-		}
-
-		parts := strings.SplitN(val[0], ".", 2)
-		if len(parts) != 2 {
-			continue
-		}
-
-		op, v := parts[0], parts[1]
-		col := goqu.C(key)
+	filters, err := buildFilters(table, def, filterParams)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+	if len(filters) > 0 {
+		query = query.Where(filters...)
+	}
 
-		switch op {
-		case "eq":
-			query = query.Where(col.Eq(v))
-		case "gt":
-			query = query.Where(col.Gt(v))
-		case "lt":
-			query = query.Where(col.Lt(v))
-		case "gte":
-			query = query.Where(col.Gte(v))
-		case "lte":
-			query = query.Where(col.Lte(v))
-		case "like":
-			// Use goqu's Like to safely build LIKE expressions with identifiers
-			query = query.Where(goqu.C(key).Like(v))
-		case "in":
-			values := strings.Split(v, ",")
-			query = query.Where(col.In(values))
-		}
+	// !inner embeds drop the parent rows without a matching embedded row
+	if inner, err := innerEmbedFilters(ctx, db, table, items, params); err != nil {
+		return SQLQuery{}, err
+	} else if len(inner) > 0 {
+		query = query.Where(inner...)
 	}
 
 	// Handle dynamic joins
-	joins := parseJoins(params, table)
+	joins := parseJoins(joinParams, table, items)
 	for _, join := range joins {
 		query = applyJoin(query, join, table)
 	}
 
+	if query, err = applyPaging(query, def, params); err != nil {
+		return SQLQuery{}, err
+	}
+
+	sql, values, err := query.Prepared(true).ToSQL()
+	if err != nil {
+		return SQLQuery{}, err
+	}
+
+	return SQLQuery{
+		Query:  sql,
+		Values: values,
+	}, nil
+}
+
+// innerEmbedFilters returns the EXISTS conditions of the top-level !inner embeds of table
+func innerEmbedFilters(ctx context.Context, db Querier, table string, items []SelectItem, params url.Values) ([]exp.Expression, error) {
+	for _, item := range items {
+		if item.Embed != nil && item.Embed.Inner {
+			cache, err := getSchemaCache(ctx, db)
+			if err != nil {
+				return nil, err
+			}
+			return innerEmbedConditions(cache, table, table, items, params, "", 1)
+		}
+	}
+	return nil, nil
+}
+
+// QueryError is a malformed or unknown part of the query string. It is the
+// client's mistake and is reported as 400 with Code as a machine-readable kind.
+type QueryError struct {
+	Code    string // unknown_column, unknown_embed, bad_operator, invalid_filter, invalid_order, invalid_limit or invalid_offset
+	Param   string // the query parameter the error was found in
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Param, e.Message)
+}
+
+// errTableNotFound is wrapped by lookupTable for a table missing from the tenant schema
+var errTableNotFound = errors.New("table not found in tenant schema")
+
+// lookupTable returns the cached definition of table. Only tables of the tenant
+// schema are found, so a name such as other_tenant.authors cannot reach another schema.
+func lookupTable(ctx context.Context, db Querier, table string) (*Table, error) {
+	cache, err := getSchemaCache(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	def, ok := cache.Tables[table]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", errTableNotFound, table)
+	}
+	return def, nil
+}
+
+// checkColumn reports a column that def does not have. A nil def skips the check.
+func checkColumn(def *Table, param, column string) error {
+	if def == nil || def.HasColumn(column) {
+		return nil
+	}
+	return &QueryError{
+		Code:    "unknown_column",
+		Param:   param,
+		Message: fmt.Sprintf("column '%s' does not exist on '%s'", column, def.Name),
+	}
+}
+
+// checkSelectColumns verifies the plain columns of a select= list against def
+func checkSelectColumns(def *Table, items []SelectItem) error {
+	for _, item := range items {
+		if item.Embed != nil || item.Column == "*" {
+			continue
+		}
+		if err := checkColumn(def, "select", item.Column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPaging applies the order, limit and offset parameters to query,
+// checking the order column against def when it is known
+func applyPaging(query *goqu.SelectDataset, def *Table, params url.Values) (*goqu.SelectDataset, error) {
 	// Handle ORDER BY
 	if order := params.Get("order"); order != "" {
-		parts := strings.SplitN(order, ".", 2)
-		col := goqu.C(parts[0])
-		if len(parts) > 1 && parts[1] == "desc" {
-			query = query.Order(col.Desc())
-		} else {
+		column, dir, _ := strings.Cut(order, ".")
+		target, err := filterTarget("invalid_order", "order", column)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkColumn(def, "order", target.Column); err != nil {
+			return nil, err
+		}
+		col, _ := targetExpr("", def, target)
+		switch dir {
+		case "", "asc":
 			query = query.Order(col.Asc())
+		case "desc":
+			query = query.Order(col.Desc())
+		default:
+			return nil, &QueryError{
+				Code:    "invalid_order",
+				Param:   "order",
+				Message: fmt.Sprintf("unknown direction '%s', expected asc or desc", dir),
+			}
 		}
 	}
 
 	// Handle LIMIT
 	if limit := params.Get("limit"); limit != "" {
-		if n, err := strconv.Atoi(limit); err == nil {
-			query = query.Limit(uint(n))
+		n, err := strconv.ParseUint(limit, 10, 0)
+		if err != nil {
+			return nil, &QueryError{
+				Code:    "invalid_limit",
+				Param:   "limit",
+				Message: fmt.Sprintf("'%s' is not a non-negative integer", limit),
+			}
 		}
+		query = query.Limit(uint(n))
 	}
 
 	// Handle OFFSET
 	if offset := params.Get("offset"); offset != "" {
-		if n, err := strconv.Atoi(offset); err == nil {
-			query = query.Offset(uint(n))
+		n, err := strconv.ParseUint(offset, 10, 0)
+		if err != nil {
+			return nil, &QueryError{
+				Code:    "invalid_offset",
+				Param:   "offset",
+				Message: fmt.Sprintf("'%s' is not a non-negative integer", offset),
+			}
 		}
+		query = query.Offset(uint(n))
 	}
 
-	sql, values, _ := query.ToSQL()
+	return query, nil
+}
 
-	return SQLQuery{
-		Query:  sql,
-		Values: values,
+// buildSelectColumns turns parsed select= items into goqu select expressions for table,
+// rendering embedded resources as correlated json subqueries filtered by their dotted params
+func buildSelectColumns(ctx context.Context, db Querier, table string, items []SelectItem, params url.Values) ([]any, error) {
+	// The schema cache is only needed once an embed shows up
+	var cache *SchemaCache
+	for _, item := range items {
+		if item.Embed != nil {
+			var err error
+			if cache, err = getSchemaCache(ctx, db); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return buildNestedSelect(cache, table, table, items, params, "", 1)
+}
+
+// selectColumn renders a plain column item, qualified by table when set. Cast columns
+// and JSON paths keep the column name or last JSON key as the JSON key unless they are aliased.
+func selectColumn(item SelectItem, table string) any {
+	if item.Column == "*" {
+		if table != "" {
+			return goqu.T(table).All()
+		}
+		return goqu.Star()
+	}
+
+	column := goqu.C(item.Column)
+	if table != "" {
+		column = goqu.T(table).Col(item.Column)
+	}
+	var col interface {
+		exp.Expression
+		exp.Aliaseable
+	} = column
+	named := item.Alias != ""
+	if len(item.JSONPath) > 0 {
+		col = jsonPathExpr(column, item.JSONPath)
+		named = true
+	}
+	if item.Cast != "" {
+		col = goqu.Cast(col, item.Cast)
+		named = true
+	}
+	if !named {
+		return col
+	}
+	return col.As(item.Key())
+}
+
+// jsonPathExpr follows the -> and ->> steps of path from col. Keys are bound, and
+// keys made of digits are bound as integers so they index arrays.
+func jsonPathExpr(col exp.Expression, path []JSONStep) exp.LiteralExpression {
+	var expr exp.LiteralExpression
+	for _, step := range path {
+		op := "->"
+		if step.Text {
+			op = "->>"
+		}
+		if n, err := strconv.Atoi(step.Key); err == nil {
+			expr = goqu.L("? "+op+" ?::integer", col, n)
+		} else {
+			expr = goqu.L("? "+op+" ?", col, step.Key)
+		}
+		col = expr
+	}
+	return expr
+}
+
+// filterTarget parses the column a filter or order applies to: a plain column, or a
+// JSON path into one such as metadata->>status. code is the QueryError code for a
+// malformed path.
+func filterTarget(code, param, target string) (SelectItem, error) {
+	if !strings.Contains(target, "->") {
+		return SelectItem{Column: target}, nil
+	}
+	items, err := ParseSelect(target)
+	if err == nil && (len(items) != 1 || items[0].Embed != nil || items[0].Alias != "" || items[0].Cast != "") {
+		err = fmt.Errorf("expected a column or JSON path like data->a->>b")
+	}
+	if err != nil {
+		return SelectItem{}, &QueryError{Code: code, Param: param, Message: fmt.Sprintf("invalid column '%s': %v", target, err)}
+	}
+	return items[0], nil
+}
+
+// targetExpr is the expression a filter compares for target, with the column
+// qualified by table when set, and the target's type when it is known
+func targetExpr(table string, def *Table, target SelectItem) (filterColumn, string) {
+	col := goqu.C(target.Column)
+	if table != "" {
+		col = goqu.T(table).Col(target.Column)
+	}
+	if len(target.JSONPath) > 0 {
+		return jsonPathExpr(col, target.JSONPath), ""
+	}
+	return col, def.ColumnType(target.Column)
+}
+
+// buildEmbed renders the embedded resource of item, related to parentTable, as a
+// correlated subquery named after the item's alias or the embed name.
+// parentRef is how the parent row is referenced in the enclosing query, and every
+// embedded table gets an alias suffixed with its depth so self-references stay unambiguous.
+// path is the dotted prefix of the params addressed to the embed, like posts.stats.
+func buildEmbed(cache *SchemaCache, parentTable, parentRef string, item SelectItem, params url.Values, path string, depth int) (exp.Expression, error) {
+	embed := item.Embed
+	rel, query, err := embedRows(cache, parentTable, parentRef, embed, params, path, depth)
+	if err != nil {
+		return nil, err
+	}
+	name := item.Key()
+	alias := fmt.Sprintf("%s_%d", embed.Name, depth)
+	def := cache.Tables[rel.Target]
+	embedded := embedParams(params, path)
+
+	// Recursively build the nested select columns
+	nestedSelect, err := buildNestedSelect(cache, rel.Target, alias, embed.Select, params, path, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows are kept as a subquery so their filter values stay bound parameters
+	if rel.ToOne {
+		// Many-to-one relationship: the parent holds the foreign key
+		// Return a single JSON object (not an array) of the selected columns
+		if err := checkToOneParams(embedded); err != nil {
+			return nil, embedParamError(err, path)
+		}
+		rows := query.Select(nestedSelect...).Limit(1)
+		return goqu.L("(SELECT row_to_json(arr) FROM ? arr)", rows).As(name), nil
+	}
+
+	// posts.order, posts.limit and posts.offset page the embedded rows
+	query, err = applyPaging(query.Select(nestedSelect...), def, embedded)
+	if err != nil {
+		return nil, embedParamError(err, path)
+	}
+
+	// One-to-many (or many-to-many through a junction table) relationship
+	// Return an array of JSON objects
+	if embed.Inner {
+		// INNER JOIN: parents without related rows are dropped, so the array is never empty
+		return goqu.L("(SELECT json_agg(row_to_json(arr)) FROM ? arr)", query).As(name), nil
+	}
+	// LEFT JOIN: include all rows, with empty array for no matches
+	return goqu.L("(SELECT COALESCE(json_agg(row_to_json(arr)), '[]'::json) FROM ? arr)", query).As(name), nil
+}
+
+// checkToOneParams rejects paging params on a to-one embed, which holds a single row
+func checkToOneParams(embedded url.Values) error {
+	for _, key := range []string{"order", "limit", "offset"} {
+		if embedded.Has(key) {
+			return &QueryError{
+				Code:    pagingParamCodes[key],
+				Param:   key,
+				Message: fmt.Sprintf("'%s' does not apply to a to-one embed, which holds a single row", key),
+			}
+		}
+	}
+	return nil
+}
+
+// embedRows selects the rows of embed that belong to the parent row, narrowed by the
+// embed's own filters such as posts.content=like.*go* and by the !inner embeds nested in it
+func embedRows(cache *SchemaCache, parentTable, parentRef string, embed *Embed, params url.Values, path string, depth int) (Relationship, *goqu.SelectDataset, error) {
+	rel, err := cache.FindRelationship(parentTable, embed.Name, embed.Hint)
+	if err != nil {
+		return rel, nil, err
+	}
+
+	alias := fmt.Sprintf("%s_%d", embed.Name, depth)
+	cond := joinCondition(rel, quoteIdent(parentRef), quoteIdent(alias), depth)
+	filters, err := buildFilters(alias, cache.Tables[rel.Target], embedParams(params, path))
+	if err != nil {
+		return rel, nil, embedParamError(err, path)
+	}
+	inner, err := innerEmbedConditions(cache, rel.Target, alias, embed.Select, params, path, depth+1)
+	if err != nil {
+		return rel, nil, err
+	}
+
+	query := goqu.Dialect("postgres").
+		From(goqu.T(rel.Target).As(alias)).
+		Where(goqu.L(cond)).
+		Where(filters...).
+		Where(inner...)
+	return rel, query, nil
+}
+
+// innerEmbedConditions builds an EXISTS condition for every !inner embed in items,
+// so rows of table (referenced as ref) without a matching embedded row are dropped.
+// path is the dotted params prefix of table, empty for the top-level table.
+func innerEmbedConditions(cache *SchemaCache, table, ref string, items []SelectItem, params url.Values, path string, depth int) ([]exp.Expression, error) {
+	var conds []exp.Expression
+	for _, item := range items {
+		if item.Embed == nil || !item.Embed.Inner {
+			continue
+		}
+		_, rows, err := embedRows(cache, table, ref, item.Embed, params, embedPath(path, item.Key()), depth)
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, goqu.L("EXISTS ?", rows.Select(goqu.L("1"))))
+	}
+	return conds, nil
+}
+
+// embedPath is the dotted params prefix of the embed name below path
+func embedPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// embedParams collects the params addressed to the embed at path, keyed by their
+// name inside the embed: posts.order=id.desc becomes order=id.desc for path posts.
+// Params of deeper embeds, like posts.stats.views, are left for those embeds.
+func embedParams(params url.Values, path string) url.Values {
+	embedded := url.Values{}
+	for key, val := range params {
+		name, ok := strings.CutPrefix(key, path+".")
+		if !ok || (strings.Contains(name, ".") && !logicOperators[name]) {
+			continue
+		}
+		embedded[name] = val
+	}
+	return embedded
+}
+
+// checkEmbedParams reports dotted params, like post.id=eq.1 or posts.limit=1, that do
+// not address an embed in items and would otherwise be ignored. name.select is left
+// for the legacy join configured by a name= param (see parseJoins).
+func checkEmbedParams(items []SelectItem, params url.Values) error {
+	paths := make(map[string]bool)
+	collectEmbedPaths(items, "", paths)
+	for key := range params {
+		if logicOperators[key] || !strings.Contains(key, ".") {
+			continue
+		}
+		if name, ok := strings.CutSuffix(key, ".select"); ok && params.Has(name) {
+			continue
+		}
+		if !addressesEmbed(key, paths) {
+			return &QueryError{
+				Code:    "unknown_embed",
+				Param:   key,
+				Message: fmt.Sprintf("'%s' does not address an embedded resource in select", key),
+			}
+		}
+	}
+	return nil
+}
+
+// collectEmbedPaths adds the dotted params prefix of every embed in items below path
+func collectEmbedPaths(items []SelectItem, path string, paths map[string]bool) {
+	for _, item := range items {
+		if item.Embed != nil {
+			p := embedPath(path, item.Key())
+			paths[p] = true
+			collectEmbedPaths(item.Embed.Select, p, paths)
+		}
 	}
 }
 
-// isRelatedResource checks if a key is a related resource (like a table reference)
-func isRelatedResource(key string, params url.Values) bool {
-	// Check if there are any dot-notation params for this key (like "posts.select")
-	for paramKey := range params {
-		if strings.HasPrefix(paramKey, key+".") {
+// addressesEmbed reports whether key is a param of one of the embeds at paths,
+// read the same way as embedParams does
+func addressesEmbed(key string, paths map[string]bool) bool {
+	for path := range paths {
+		name, ok := strings.CutPrefix(key, path+".")
+		if ok && (!strings.Contains(name, ".") || logicOperators[name]) {
 			return true
 		}
 	}
 	return false
 }
 
-// parseJoins extracts join configurations from query parameters
-func parseJoins(params url.Values, mainTable string) []JoinConfig {
-	var joins []JoinConfig
+// embedParamError restores the full dotted param name in errors from an embed's params
+func embedParamError(err error, path string) error {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		queryErr.Param = path + "." + queryErr.Param
+	}
+	return err
+}
+
+// joinCondition correlates the embedded alias with the parent row through rel.
+// Many-to-many embeds go through the junction table in an EXISTS so the
+// subquery keeps selecting from the target table alone.
+func joinCondition(rel Relationship, parentRef, aliasRef string, depth int) string {
+	switch {
+	case rel.Junction != nil:
+		junctionRef := quoteIdent(fmt.Sprintf("%s_%d", rel.Junction.Table, depth))
+		return fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM %s AS %s WHERE %s AND %s)",
+			quoteIdent(rel.Junction.Table), junctionRef,
+			fkCondition(rel.Junction.TargetFK, junctionRef, aliasRef),
+			fkCondition(rel.Junction.ParentFK, junctionRef, parentRef),
+		)
+	case rel.ToOne:
+		return fkCondition(rel.FK, parentRef, aliasRef)
+	default:
+		return fkCondition(rel.FK, aliasRef, parentRef)
+	}
+}
+
+// fkCondition matches the columns of fk on the referencing side to the referenced side
+func fkCondition(fk ForeignKey, fkRef, refRef string) string {
+	conds := make([]string, len(fk.Columns))
+	for i, col := range fk.Columns {
+		conds[i] = fmt.Sprintf("%s.%s = %s.%s", fkRef, quoteIdent(col), refRef, quoteIdent(fk.RefColumns[i]))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// quoteIdent quotes a single SQL identifier
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// reservedParams are query parameters that configure the request rather than filter columns
+var reservedParams = map[string]bool{
+	"select": true, "order": true, "limit": true, "offset": true,
+	"columns": true, "on_conflict": true,
+	"or": true, "and": true, "not.or": true, "not.and": true,
+}
 
-	// List of filter operators that should not be treated as join configurations
-	filterOperators := map[string]bool{
-		"eq": true, "gt": true, "lt": true, "gte": true, "lte": true,
-		"like": true, "in": true,
+// buildFilters turns column filters such as author_id=eq.5 and or=(...) groups into
+// WHERE expressions on table.
+// Keys are visited in sorted order so the generated SQL is stable. When def is known,
+// filtered columns are checked against it.
+func buildFilters(table string, def *Table, params url.Values) ([]exp.Expression, error) {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+
+	var filters []exp.Expression
+	for _, key := range keys {
+		// A repeated key such as id=gt.1&id=lt.5 adds one filter per value
+		for _, val := range params[key] {
+			filter, err := buildParamFilter(table, def, key, val)
+			if err != nil {
+				return nil, err
+			}
+			if filter != nil {
+				filters = append(filters, filter)
+			}
+		}
+	}
+	return filters, nil
+}
+
+// buildParamFilter compiles one value of the query parameter key, or returns nil
+// when key configures the request rather than filtering it
+func buildParamFilter(table string, def *Table, key, val string) (exp.Expression, error) {
+	if logicOperators[key] {
+		return buildLogicFilter(table, def, key, val)
+	}
+	if reservedParams[key] || strings.Contains(key, ".") {
+		return nil, nil
+	}
+
+	target, err := filterTarget("invalid_filter", key, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkColumn(def, key, target.Column); err != nil {
+		return nil, err
+	}
+	col, colType := targetExpr(table, def, target)
+	return buildFilter(col, colType, key, val)
+}
+
+// splitJoinParams separates the params parseJoins reads as legacy join configuration
+// from the filters. A key only configures a join when it names another table of the
+// schema cache and is not a column of def: relation(cols), or related_table=fk.pk
+// together with its related_table.select. Everything else is left to buildFilters,
+// so a mistyped filter such as nmae=eqq.x is reported rather than joined.
+func splitJoinParams(cache *SchemaCache, def *Table, params url.Values) (filters, joins url.Values) {
+	filters, joins = url.Values{}, url.Values{}
+	for key, val := range params {
+		if !isJoinParam(cache, def, key, val[0]) {
+			filters[key] = val
+			continue
+		}
+		joins[key] = val
+		if sel, ok := params[key+".select"]; ok {
+			joins[key+".select"] = sel
+		}
+	}
+	return filters, joins
+}
+
+// isJoinParam reports whether key=val configures a legacy join (see parseJoins)
+func isJoinParam(cache *SchemaCache, def *Table, key, val string) bool {
+	if reservedParams[key] || logicOperators[key] || strings.Contains(key, ".") {
+		return false
+	}
+	if name, _, found := strings.Cut(key, "("); found {
+		return cache.Tables[name] != nil
+	}
+	if cache.Tables[key] == nil || def.HasColumn(key) {
+		return false
+	}
+	op, _, found := strings.Cut(val, ".")
+	return found && !isFilterOperator(op)
+}
+
+// parseJoins extracts join configurations from query parameters
+func parseJoins(params url.Values, mainTable string, items []SelectItem) []JoinConfig {
+	var joins []JoinConfig
 
 	// Check if embedded relations are already in the select parameter (to avoid duplicate handling)
-	embeddedRelations := extractEmbeddedRelations(params.Get("select"))
+	embeddedRelations := make(map[string]bool)
+	for _, item := range items {
+		if item.Embed != nil {
+			embeddedRelations[item.Embed.Name] = true
+		}
+	}
 
 	// Look for patterns like: related_table=fk_column.pk_column
 	// Or shorthand: related_table where we infer the foreign key
 	for key, val := range params {
-		if strings.Contains(key, ".") || key == "select" || key == "order" || key == "limit" || key == "offset" {
+		if strings.Contains(key, ".") || reservedParams[key] {
 			continue
 		}
 
@@ -228,7 +663,7 @@ func parseJoins(params url.Values, mainTable string) []JoinConfig {
 			parts := strings.SplitN(val[0], ".", 2)
 			if len(parts) == 2 {
 				// Skip if the first part is a filter operator (e.g., "eq", "gt", etc.)
-				if filterOperators[parts[0]] {
+				if isFilterOperator(parts[0]) {
 					continue
 				}
 
@@ -266,165 +701,63 @@ func parseJoins(params url.Values, mainTable string) []JoinConfig {
 
 // parseParenthesesJoin parses join in format: tablename(col1,col2)
 func parseParenthesesJoin(param string) *JoinConfig {
-	re := regexp.MustCompile(`^(\w+)\((.*)\)$`)
-	matches := re.FindStringSubmatch(param)
-	if len(matches) < 3 {
+	items, err := ParseSelect(param)
+	if err != nil || len(items) != 1 || items[0].Embed == nil {
 		return nil
 	}
-
-	tableName := matches[1]
-	columnStr := matches[2]
+	embed := items[0].Embed
 
 	join := &JoinConfig{
-		Table: tableName,
+		Table: embed.Name,
 	}
 
-	if columnStr != "" {
-		cols := strings.Split(columnStr, ",")
-		for i := range cols {
-			cols[i] = strings.TrimSpace(cols[i])
+	for _, item := range embed.Select {
+		if item.Embed == nil {
+			join.Columns = append(join.Columns, item.Column)
 		}
-		join.Columns = cols
 	}
 
 	// Infer foreign key (assumption: fk column is {related_table}_id)
-	join.OnLeft = fmt.Sprintf("%s_id", tableName)
+	join.OnLeft = fmt.Sprintf("%s_id", embed.Name)
 	join.OnRight = "id"
 
 	return join
 }
 
-// buildNestedSelect recursively builds SELECT columns for nested relationships
-func buildNestedSelect(ctx context.Context, db Querier, parentTable string, colsStr string, previousTableSingular string) string {
-	if colsStr == "" {
-		return "*"
-	}
-
-	fields := splitSelectFields(colsStr)
-	var selectParts []string
-
-	for _, f := range fields {
-		f = strings.TrimSpace(f)
-
-		// Check if this field has nested relations like: stats(views) or stats!inner(views)
-		if strings.Contains(f, "(") && strings.Contains(f, ")") {
-			re := regexp.MustCompile(`^(\w+)(!inner)?\((.*)\)$`)
-			m := re.FindStringSubmatch(f)
-			if len(m) == 4 {
-				nestedTable := m[1]
-				joinTypeMarker := m[2] // "!inner" or ""
-				nestedColsStr := m[3]
-				useInnerJoin := joinTypeMarker == "!inner"
-
-				// Determine relationship type between parentTable and nestedTable
-				parentSingular := singularize(parentTable)
-				nestedSingular := singularize(nestedTable)
-
-				manyToOneFK := fmt.Sprintf("%s_%s", nestedSingular, "id")
-				oneToManyFK := fmt.Sprintf("%s_%s", parentSingular, "id")
-
-				// Check which foreign key exists
-				isManyToOne := columnExists(ctx, db, parentTable, manyToOneFK)
-
-				// Recursively build nested select
-				nestedSelectSQL := buildNestedSelect(ctx, db, nestedTable, nestedColsStr, parentSingular)
-
-				if isManyToOne {
-					// Many-to-one: return a single JSON object
-					subQuery := fmt.Sprintf(
-						"(SELECT row_to_json(%s.*) FROM %s WHERE %s.id = %s.%s LIMIT 1) AS %s",
-						nestedTable, nestedTable, nestedTable, parentTable, manyToOneFK, nestedTable,
-					)
-					selectParts = append(selectParts, subQuery)
-				} else {
-					// One-to-many: return an array of JSON objects
-					var subQuery string
-					if useInnerJoin {
-						// INNER JOIN: only include if related rows exist (no COALESCE to array)
-						subQuery = fmt.Sprintf(
-							"(SELECT json_agg(row_to_json(arr)) FROM (SELECT %s FROM %s WHERE %s.%s = %s.id) arr) AS %s",
-							nestedSelectSQL, nestedTable, nestedTable, oneToManyFK, parentTable, nestedTable,
-						)
-					} else {
-						// LEFT JOIN: include all rows, with empty array for no matches
-						subQuery = fmt.Sprintf(
-							"(SELECT COALESCE(json_agg(row_to_json(arr)), '[]'::json) FROM (SELECT %s FROM %s WHERE %s.%s = %s.id) arr) AS %s",
-							nestedSelectSQL, nestedTable, nestedTable, oneToManyFK, parentTable, nestedTable,
-						)
-					}
-					selectParts = append(selectParts, subQuery)
-				}
-				continue
-			}
-		}
-
-		// Regular column
-		selectParts = append(selectParts, f)
+// buildNestedSelect recursively builds the select expressions of a select= list.
+// table is the selected table, alias the name it is referenced by in the query
+// and path the dotted params prefix of the embed, empty at the top level.
+func buildNestedSelect(cache *SchemaCache, table, alias string, items []SelectItem, params url.Values, path string, depth int) ([]any, error) {
+	if len(items) == 0 {
+		return []any{goqu.Star()}, nil
 	}
 
-	if len(selectParts) == 0 {
-		return "*"
-	}
-	return strings.Join(selectParts, ",")
-}
-
-// splitSelectFields splits top-level comma-separated select fields, keeping parenthesis groups intact
-func splitSelectFields(s string) []string {
-	var fields []string
-	var cur strings.Builder
-	depth := 0
-	for _, r := range s {
-		switch r {
-		case ',':
-			if depth == 0 {
-				fields = append(fields, cur.String())
-				cur.Reset()
-				continue
-			}
-		case '(':
-			depth++
-		case ')':
-			if depth > 0 {
-				depth--
-			}
+	// The columns of an embed are checked and qualified with its alias; an unqualified
+	// missing column would otherwise resolve to the correlated parent row
+	qualifier := ""
+	if path != "" {
+		if err := checkSelectColumns(cache.Tables[table], items); err != nil {
+			return nil, err
 		}
-		cur.WriteRune(r)
-	}
-	if cur.Len() > 0 {
-		fields = append(fields, cur.String())
-	}
-	return fields
-}
-
-// singularize makes a naive singular form for a plural table name
-func singularize(name string) string {
-	if strings.HasSuffix(name, "ies") {
-		return strings.TrimSuffix(name, "ies") + "y"
+		qualifier = alias
 	}
-	if strings.HasSuffix(name, "s") {
-		return strings.TrimSuffix(name, "s")
-	}
-	return name
-}
 
-// extractEmbeddedRelations extracts table names from embedded select fields like "posts(id,content)"
-func extractEmbeddedRelations(selectStr string) map[string]bool {
-	embedded := make(map[string]bool)
-	if selectStr == "" {
-		return embedded
-	}
-	fields := splitSelectFields(selectStr)
-	for _, f := range fields {
-		f = strings.TrimSpace(f)
-		if strings.Contains(f, "(") && strings.Contains(f, ")") {
-			re := regexp.MustCompile(`^(\w+)\(`)
-			m := re.FindStringSubmatch(f)
-			if len(m) > 1 {
-				embedded[m[1]] = true
+	selectCols := make([]any, 0, len(items))
+	for _, item := range items {
+		// Nested relations like: stats(views) or stats!inner(views)
+		if item.Embed != nil {
+			subQuery, err := buildEmbed(cache, table, alias, item, params, embedPath(path, item.Key()), depth)
+			if err != nil {
+				return nil, err
 			}
+			selectCols = append(selectCols, subQuery)
+			continue
 		}
+
+		// Regular column
+		selectCols = append(selectCols, selectColumn(item, qualifier))
 	}
-	return embedded
+	return selectCols, nil
 }
 
 // applyJoin applies a JOIN to the query
@@ -451,20 +784,3 @@ func applyJoin(query *goqu.SelectDataset, join JoinConfig, mainTable string) *go
 
 	return query
 }
-
-// columnExists checks if a column exists in a table by querying the database
-func columnExists(ctx context.Context, db Querier, table string, column string) bool {
-	query := `
-		SELECT EXISTS (
-			SELECT 1 FROM information_schema.columns 
-			WHERE table_name = $1 AND column_name = $2
-		)
-	`
-	var exists bool
-	err := db.QueryRow(ctx, query, table, column).Scan(&exists)
-	if err != nil {
-		// If there's an error, assume column doesn't exist
-		return false
-	}
-	return exists
-}
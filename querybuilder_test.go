@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBuildQueryErrors tests that malformed query parameters are reported instead of ignored
+func TestBuildQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		code  string
+		param string
+	}{
+		{"id=equals.1", "bad_operator", "id"},
+		{"id=5", "invalid_filter", "id"},
+		{"nickname=eq.x", "unknown_column", "nickname"},
+		{"nmae=eqq.x", "unknown_column", "nmae"},
+		{"first_name=eqq.x", "bad_operator", "first_name"},
+		{"nmae(id)=eq.x", "unknown_column", "nmae(id)"},
+		{"select=id,nickname", "unknown_column", "select"},
+		{"select=id,posts!author_id(nickname)", "unknown_column", "select"},
+		{"select=id,posts!author_id(first_name)", "unknown_column", "select"},
+		{"select=id,posts!author_id(id,stats(first_name))", "unknown_column", "select"},
+		{"order=nickname.desc", "unknown_column", "order"},
+		{"order=id.sideways", "invalid_order", "order"},
+		{"limit=ten", "invalid_limit", "limit"},
+		{"limit=-1", "invalid_limit", "limit"},
+		{"offset=x", "invalid_offset", "offset"},
+		{"first_name->=eq.x", "invalid_filter", "first_name->"},
+		{"nickname->>a=eq.x", "unknown_column", "nickname->>a"},
+		{"order=first_name->>.desc", "invalid_order", "order"},
+		{"order=nickname->a", "unknown_column", "order"},
+	}
+
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		_, err := BuildQuery(testContext(), nil, "authors", params)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("%s: expected a QueryError, got: %v", tt.query, err)
+			continue
+		}
+		if queryErr.Code != tt.code || queryErr.Param != tt.param {
+			t.Errorf("%s: expected %s in %s, got %s in %s", tt.query, tt.code, tt.param, queryErr.Code, queryErr.Param)
+		}
+	}
+
+	// A to-one embed holds a single row, so it cannot be ordered or paged
+	for query, code := range map[string]string{
+		"select=id,authors!author_id(id)&authors.order=id.desc": "invalid_order",
+		"select=id,authors!author_id(id)&authors.limit=1":       "invalid_limit",
+		"select=id,authors!author_id(id)&authors.offset=1":      "invalid_offset",
+	} {
+		params, _ := url.ParseQuery(query)
+		_, err := BuildQuery(testContext(), nil, "posts", params)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) || queryErr.Code != code || !strings.HasPrefix(queryErr.Param, "authors.") {
+			t.Errorf("%s: expected %s on authors, got: %v", query, code, err)
+		}
+	}
+
+	// Dotted params must address an embed in select
+	params, _ := url.ParseQuery("select=id&posts.limit=1")
+	var queryErr *QueryError
+	if _, err := BuildQuery(testContext(), nil, "authors", params); !errors.As(err, &queryErr) || queryErr.Code != "unknown_embed" {
+		t.Errorf("Expected unknown_embed for params of a missing embed, got: %v", err)
+	}
+
+	// related_table=fk.pk only configures a join for a table of the schema
+	params, _ = url.ParseQuery("posts=id.author_id")
+	if sql, err := BuildQuery(testContext(), nil, "authors", params); err != nil || !strings.Contains(sql.Query, `LEFT JOIN "posts"`) {
+		t.Errorf("Expected a legacy join, got %s (%v)", sql.Query, err)
+	}
+
+	// Tables missing from the schema cache are not queried
+	params, _ = url.ParseQuery("anything=eq.1&limit=5")
+	for _, table := range []string{"not_cached", "other_tenant.authors", "pg_catalog.pg_authid"} {
+		if _, err := BuildQuery(testContext(), nil, table, params); !errors.Is(err, errTableNotFound) {
+			t.Errorf("%s: expected errTableNotFound, got: %v", table, err)
+		}
+	}
+}
+
+// TestBuildQueryEmbedParams tests that dotted params filter and page the matching embed
+func TestBuildQueryEmbedParams(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,posts!author_id(id,stats(views))" +
+		"&posts.content=like.*go*&posts.order=id.desc&posts.limit=3&posts.stats.views=gt.100")
+	sql, err := BuildQuery(testContext(), nil, "authors", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		`WHERE ("stats_2"."post_id" = "posts_1"."id" AND ("stats_2"."views" > $1))`,
+		`WHERE ("posts_1"."author_id" = "authors"."id" AND ("posts_1"."content" LIKE $2)) ORDER BY "id" DESC LIMIT $3`,
+	} {
+		if !strings.Contains(sql.Query, want) {
+			t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+		}
+	}
+	if want := []any{"100", "%go%", int64(3)}; !reflect.DeepEqual(sql.Values, want) {
+		t.Errorf("Expected values %v, got: %v", want, sql.Values)
+	}
+	if strings.Contains(sql.Query, `"authors"."content"`) {
+		t.Errorf("Expected embed params to stay out of the parent query, got: %s", sql.Query)
+	}
+
+	for query, param := range map[string]string{
+		"posts.nickname=eq.x":          "posts.nickname",
+		"posts.limit=x":                "posts.limit",
+		"posts.stats.order=views.down": "posts.stats.order",
+		"post.id=eq.1":                 "post.id",
+		"stats.limit=1":                "stats.limit",
+		"posts.stat.views=gt.1":        "posts.stat.views",
+	} {
+		params, _ := url.ParseQuery("select=id,posts!author_id(id,stats(views))&" + query)
+		_, err := BuildQuery(testContext(), nil, "authors", params)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) || queryErr.Param != param {
+			t.Errorf("%s: expected a QueryError in %s, got: %v", query, param, err)
+		}
+	}
+}
+
+// TestBuildQueryInnerEmbeds tests that !inner embeds filter their parent rows with EXISTS
+func TestBuildQueryInnerEmbeds(t *testing.T) {
+	tests := []struct {
+		table string
+		query string
+		want  []string
+	}{
+		{
+			"authors", "select=id,posts!author_id!inner(id)&posts.content=like.*go*",
+			[]string{`FROM "authors" WHERE EXISTS (SELECT 1 FROM "posts" AS "posts_1" WHERE ("posts_1"."author_id" = "authors"."id" AND ("posts_1"."content" LIKE $2)))`},
+		},
+		{
+			"posts", "select=id,authors!author_id!inner(first_name)",
+			[]string{`FROM "posts" WHERE EXISTS (SELECT 1 FROM "authors" AS "authors_1" WHERE "posts"."author_id" = "authors_1"."id")`},
+		},
+		{
+			"authors", "select=id,posts!author_id(id,stats!inner(views))",
+			[]string{`FROM "posts" AS "posts_1" WHERE ("posts_1"."author_id" = "authors"."id" AND EXISTS (SELECT 1 FROM "stats" AS "stats_2" WHERE "stats_2"."post_id" = "posts_1"."id"))`},
+		},
+	}
+
+	for _, tt := range tests {
+		params, _ := url.ParseQuery(tt.query)
+		sql, err := BuildQuery(testContext(), nil, tt.table, params)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.query, err)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(sql.Query, want) {
+				t.Errorf("%s: expected %q in query, got: %s", tt.query, want, sql.Query)
+			}
+		}
+	}
+
+	// Without !inner the parent rows are left alone
+	params, _ := url.ParseQuery("select=id,posts!author_id(id)")
+	if sql, _ := BuildQuery(testContext(), nil, "authors", params); strings.Contains(sql.Query, `FROM "authors" WHERE`) {
+		t.Errorf("Expected no parent filter for a left embed, got: %s", sql.Query)
+	}
+}
+
+// TestBuildQueryManyToOneColumns tests that many-to-one embeds select only the requested
+// columns and nest further embeds
+func TestBuildQueryManyToOneColumns(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,posts(content,authors!author_id(first_name))")
+	sql, err := BuildQuery(testContext(), nil, "stats", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := `(SELECT row_to_json(arr) FROM (SELECT "posts_1"."content", ` +
+		`(SELECT row_to_json(arr) FROM (SELECT "authors_2"."first_name" FROM "authors" AS "authors_2" WHERE "posts_1"."author_id" = "authors_2"."id" LIMIT $1) arr) AS "authors" ` +
+		`FROM "posts" AS "posts_1" WHERE "stats"."post_id" = "posts_1"."id" LIMIT $2) arr) AS "posts"`
+	if !strings.Contains(sql.Query, want) {
+		t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+	}
+	if strings.Contains(sql.Query, ".*") {
+		t.Errorf("Expected no whole-row selection, got: %s", sql.Query)
+	}
+}
+
+// TestBuildQueryJSONPaths tests JSON paths in select, filters and order with bound keys
+func TestBuildQueryJSONPaths(t *testing.T) {
+	params, _ := url.ParseQuery(`select=id,metadata->tags->0,state:metadata->>status&metadata->>status=eq.active` +
+		`&or=(metadata->"it's".is.null,id.eq.1)&order=metadata->>priority.desc`)
+	sql, err := BuildQuery(testContext(), nil, "documents", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := `SELECT "id", "metadata" -> $1 -> $2::integer AS "0", "metadata" ->> $3 AS "state" FROM "documents" ` +
+		`WHERE (("documents"."metadata" ->> $4 = $5) AND (("documents"."metadata" -> $6 IS NULL) OR ("documents"."id" = $7))) ` +
+		`ORDER BY "metadata" ->> $8 DESC`
+	if sql.Query != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, sql.Query)
+	}
+
+	// Keys and values are sent as parameters, digit keys as integers
+	values := []any{"tags", int64(0), "status", "status", "active", "it's", "1", "priority"}
+	if !reflect.DeepEqual(sql.Values, values) {
+		t.Errorf("Expected values %v, got: %v", values, sql.Values)
+	}
+}
+
+// TestBuildQueryRepeatedFilters tests that every value of a repeated filter is applied
+func TestBuildQueryRepeatedFilters(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,posts!author_id(id)&id=gt.1&id=lt.5&posts.id=gt.2&posts.id=lt.9")
+	sql, err := BuildQuery(testContext(), nil, "authors", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		`("posts_1"."id" > $1) AND ("posts_1"."id" < $2)`,
+		`WHERE (("authors"."id" > $3) AND ("authors"."id" < $4))`,
+	} {
+		if !strings.Contains(sql.Query, want) {
+			t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+		}
+	}
+	if want := []any{"2", "9", "1", "5"}; !reflect.DeepEqual(sql.Values, want) {
+		t.Errorf("Expected values %v, got: %v", want, sql.Values)
+	}
+}
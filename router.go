@@ -8,7 +8,13 @@ import (
 
 func NewRouter() http.Handler {
 	r := chi.NewRouter()
+	r.Use(TenantMiddleware)
 	r.Get("/{table}", HandleSelect)
+	r.Post("/{table}", HandleInsert)
+	r.Patch("/{table}", HandleUpdate)
+	r.Delete("/{table}", HandleDelete)
+	r.Get("/rpc/{function}", HandleRPC)
+	r.Post("/rpc/{function}", HandleRPC)
 
 	return r
 }
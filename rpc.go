@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// argsAlias names the CTE that exposes the typed function arguments
+const argsAlias = "pgrst_args"
+
+// errFunctionNotFound is returned when no function in the tenant's search_path accepts the given arguments
+var errFunctionNotFound = errors.New("function not found")
+
+// Function describes a Postgres function resolved for an RPC call
+type Function struct {
+	Schema    string
+	Name      string
+	ArgNames  []string // input argument names, in declaration order
+	ArgTypes  []string // input argument types as rendered by format_type
+	ReturnSet bool     // declared RETURNS SETOF or RETURNS TABLE
+	Composite bool     // returns a row type rather than a scalar
+	Volatile  bool
+}
+
+// hasArg reports whether the function takes an input argument with this name
+func (f *Function) hasArg(name string) bool {
+	for _, a := range f.ArgNames {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// functionQuery lists the overloads of a function visible through the current search_path,
+// in search_path order, with their named input arguments and return shape
+const functionQuery = `
+	SELECT n.nspname,
+		p.proretset,
+		t.typtype = 'c' OR p.prorettype = 'record'::regtype,
+		p.provolatile = 'v',
+		COALESCE(ARRAY(
+			SELECT a.name FROM unnest(
+				p.proargnames,
+				COALESCE(p.proargmodes, array_fill('i'::"char", ARRAY[COALESCE(cardinality(p.proargnames), 0)]))
+			) WITH ORDINALITY AS a(name, mode, ord)
+			WHERE a.mode IN ('i', 'b', 'v')
+			ORDER BY a.ord
+		), '{}'),
+		COALESCE(ARRAY(
+			SELECT format_type(x.typ, NULL)
+			FROM unnest(p.proargtypes::oid[]) WITH ORDINALITY AS x(typ, ord)
+			ORDER BY x.ord
+		), '{}')
+	FROM pg_proc p
+	JOIN pg_namespace n ON n.oid = p.pronamespace
+	JOIN pg_type t ON t.oid = p.prorettype
+	WHERE p.proname = $1 AND n.nspname = ANY(current_schemas(false))
+	ORDER BY array_position(current_schemas(false), n.nspname)
+`
+
+// functionOverloads lists the overloads of name visible through the search_path, in
+// search_path order. Overloads with unnamed arguments are skipped since they cannot be
+// bound from JSON keys or query parameters.
+func functionOverloads(ctx context.Context, db Querier, name string) ([]*Function, error) {
+	rows, err := db.Query(ctx, functionQuery, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overloads []*Function
+	for rows.Next() {
+		fn := &Function{Name: name}
+		if err := rows.Scan(&fn.Schema, &fn.ReturnSet, &fn.Composite, &fn.Volatile, &fn.ArgNames, &fn.ArgTypes); err != nil {
+			return nil, err
+		}
+		if len(fn.ArgNames) == len(fn.ArgTypes) {
+			overloads = append(overloads, fn)
+		}
+	}
+	return overloads, rows.Err()
+}
+
+// lookupFunction resolves name against the search_path, picking the first overload
+// whose named arguments cover every key the caller supplied
+func lookupFunction(ctx context.Context, db Querier, name string, argKeys []string) (*Function, error) {
+	overloads, err := functionOverloads(ctx, db, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range overloads {
+		matches := true
+		for _, k := range argKeys {
+			if !fn.hasArg(k) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fn, nil
+		}
+	}
+	return nil, errFunctionNotFound
+}
+
+// lookupQueryFunction resolves a GET call, where each query parameter is either an
+// argument or a filter on the result. It picks the overload that binds the most of the
+// parameters sent, preferring the one with fewest arguments and then search_path order.
+func lookupQueryFunction(ctx context.Context, db Querier, name string, params url.Values) (*Function, error) {
+	overloads, err := functionOverloads(ctx, db, name)
+	if err != nil {
+		return nil, err
+	}
+	var best *Function
+	bestBound := -1
+	for _, fn := range overloads {
+		bound := 0
+		for key := range params {
+			if fn.hasArg(key) {
+				bound++
+			}
+		}
+		if bound > bestBound || (bound == bestBound && len(fn.ArgNames) < len(best.ArgNames)) {
+			best, bestBound = fn, bound
+		}
+	}
+	if best == nil {
+		return nil, errFunctionNotFound
+	}
+	return best, nil
+}
+
+// checkScalarParams rejects the params of a scalar call: its single value cannot be
+// selected from, filtered or paged, so they would otherwise be ignored
+func checkScalarParams(fn *Function, params url.Values) error {
+	if len(params) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	key := keys[0]
+	code, ok := pagingParamCodes[key]
+	switch {
+	case key == "select":
+		code = "invalid_select"
+	case !ok:
+		code = "invalid_filter"
+	}
+	return &QueryError{
+		Code:    code,
+		Param:   key,
+		Message: fmt.Sprintf("'%s' is not an argument of %s, whose scalar result cannot be selected, filtered or paged", key, fn.Name),
+	}
+}
+
+// BuildRPC builds the call of fn with the JSON object args bound as a single parameter.
+// Functions returning rows are selected FROM so select=, filters, order, limit and offset
+// in params apply to their result; scalar functions are selected directly.
+func BuildRPC(ctx context.Context, db Querier, fn *Function, args map[string]json.RawMessage, params url.Values) (SQLQuery, error) {
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return SQLQuery{}, err
+	}
+
+	// Only pass the arguments the caller supplied so Postgres can fill in defaults
+	var callArgs, columnDefs []string
+	for i, name := range fn.ArgNames {
+		ident := pgx.Identifier{name}.Sanitize()
+		columnDefs = append(columnDefs, ident+" "+fn.ArgTypes[i])
+		if _, ok := args[name]; ok {
+			callArgs = append(callArgs, fmt.Sprintf("%s => (SELECT %s FROM %s)", ident, ident, argsAlias))
+		}
+	}
+	call := goqu.L(fmt.Sprintf("%s(%s)", pgx.Identifier{fn.Schema, fn.Name}.Sanitize(), strings.Join(callArgs, ", ")))
+
+	dialect := goqu.Dialect("postgres")
+	var query *goqu.SelectDataset
+	if fn.ReturnSet || fn.Composite {
+		items, err := ParseSelect(params.Get("select"))
+		if err != nil {
+			return SQLQuery{}, err
+		}
+		if err := checkEmbedParams(items, params); err != nil {
+			return SQLQuery{}, err
+		}
+		selectCols, err := buildSelectColumns(ctx, db, fn.Name, items, params)
+		if err != nil {
+			return SQLQuery{}, err
+		}
+		query = dialect.From(call.As(fn.Name)).Select(selectCols...)
+		// The result columns of a function are not in the schema cache, so
+		// unknown columns are left for Postgres to report
+		filters, err := buildFilters(fn.Name, nil, params)
+		if err != nil {
+			return SQLQuery{}, err
+		}
+		if len(filters) > 0 {
+			query = query.Where(filters...)
+		}
+		if query, err = applyPaging(query, nil, params); err != nil {
+			return SQLQuery{}, err
+		}
+	} else {
+		if err := checkScalarParams(fn, params); err != nil {
+			return SQLQuery{}, err
+		}
+		query = dialect.Select(call.As(fn.Name))
+	}
+
+	if len(columnDefs) > 0 {
+		query = query.With(argsAlias, dialect.From(
+			goqu.L(fmt.Sprintf("json_to_record(?) AS r(%s)", strings.Join(columnDefs, ", ")), string(argsJSON)),
+		))
+	}
+
+	sql, values, err := query.Prepared(true).ToSQL()
+	return SQLQuery{Query: sql, Values: values}, err
+}
+
+// HandleRPC calls the function named in the URL. POST takes its arguments from the
+// JSON body; GET takes them from the query parameters that match argument names.
+func HandleRPC(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "function")
+	log.Println("Function requested:", name)
+
+	params := r.URL.Query()
+	args := make(map[string]json.RawMessage)
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorResponse{Code: "invalid_body", Message: "Failed to read request body"})
+			return
+		}
+		if body = bytes.TrimSpace(body); len(body) > 0 {
+			if err := json.Unmarshal(body, &args); err != nil {
+				writeError(w, http.StatusBadRequest, errorResponse{
+					Code:    "invalid_body",
+					Message: "Invalid request body: expected a JSON object of arguments",
+					Details: err.Error(),
+				})
+				return
+			}
+		}
+	}
+
+	ctx, tx, ok := beginTenantTx(context.Background(), w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var fn *Function
+	var err error
+	if r.Method == http.MethodPost {
+		keys := make([]string, 0, len(args))
+		for k := range args {
+			keys = append(keys, k)
+		}
+		fn, err = lookupFunction(ctx, tx, name, keys)
+	} else {
+		// Any query parameter may be an argument, so resolve against all of them
+		// and then move the ones the function declares out of the filters
+		fn, err = lookupQueryFunction(ctx, tx, name, params)
+		if err == nil {
+			for key, val := range params {
+				if fn.hasArg(key) {
+					if len(val) > 1 {
+						writeBuildError(w, &QueryError{
+							Code:    "invalid_filter",
+							Param:   key,
+							Message: fmt.Sprintf("argument '%s' was given %d times", key, len(val)),
+						})
+						return
+					}
+					encoded, _ := json.Marshal(val[0])
+					args[key] = encoded
+					params.Del(key)
+				}
+			}
+		}
+	}
+	if errors.Is(err, errFunctionNotFound) {
+		writeError(w, http.StatusNotFound, errorResponse{
+			Code:    "function_not_found",
+			Message: fmt.Sprintf("Function %q not found in tenant schema", name),
+			Hint:    "Check the function name and that its named arguments match the ones sent",
+		})
+		return
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if fn.Volatile && r.Method == http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errorResponse{
+			Code:    "method_not_allowed",
+			Message: "Volatile functions must be called with POST",
+		})
+		return
+	}
+
+	sql, err := BuildRPC(ctx, tx, fn, args, params)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	log.Println("SQL Query is:", sql.Query)
+	log.Println("SQL Values are:", sql.Values)
+
+	rows, err := tx.Query(ctx, sql.Query, sql.Values...)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	results := scanRows(rows)
+	if err := rows.Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case fn.ReturnSet:
+		json.NewEncoder(w).Encode(results)
+	case len(results) == 0:
+		json.NewEncoder(w).Encode(nil)
+	case fn.Composite:
+		json.NewEncoder(w).Encode(results[0])
+	default:
+		json.NewEncoder(w).Encode(results[0][fn.Name])
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestBuildRPCSetReturning tests that set-returning functions accept select, filters and paging
+func TestBuildRPCSetReturning(t *testing.T) {
+	fn := &Function{
+		Schema:    "public",
+		Name:      "search_posts",
+		ArgNames:  []string{"term", "max_rows"},
+		ArgTypes:  []string{"text", "integer"},
+		ReturnSet: true,
+	}
+	params, _ := url.ParseQuery("select=id,content&id=gt.3&order=id.desc&limit=2")
+	args := map[string]json.RawMessage{"term": json.RawMessage(`"go"`)}
+
+	sql, err := BuildRPC(context.Background(), nil, fn, args, params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		`json_to_record($1) AS r("term" text, "max_rows" integer)`,
+		`FROM "public"."search_posts"("term" => (SELECT "term" FROM pgrst_args)) AS "search_posts"`,
+		`"search_posts"."id" > $2`,
+		`ORDER BY "id" DESC`,
+	} {
+		if !strings.Contains(sql.Query, want) {
+			t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+		}
+	}
+	if len(sql.Values) == 0 || sql.Values[0] != `{"term":"go"}` {
+		t.Errorf("Expected arguments bound as one JSON parameter, got: %v", sql.Values)
+	}
+}
+
+// TestBuildRPCScalar tests that scalar functions are selected directly
+func TestBuildRPCScalar(t *testing.T) {
+	fn := &Function{Schema: "public", Name: "post_count"}
+
+	sql, err := BuildRPC(context.Background(), nil, fn, map[string]json.RawMessage{}, url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sql.Query != `SELECT "public"."post_count"() AS "post_count"` {
+		t.Errorf("Unexpected query: %s", sql.Query)
+	}
+}
+
+// TestBuildRPCScalarParams tests that params a scalar result cannot use are rejected
+func TestBuildRPCScalarParams(t *testing.T) {
+	fn := &Function{Schema: "public", Name: "post_count"}
+
+	for query, code := range map[string]string{
+		"select=x":    "invalid_select",
+		"order=x":     "invalid_order",
+		"limit=1":     "invalid_limit",
+		"offset=1":    "invalid_offset",
+		"id=eq.1":     "invalid_filter",
+		"or=(a.eq.1)": "invalid_filter",
+	} {
+		params, _ := url.ParseQuery(query)
+		_, err := BuildRPC(context.Background(), nil, fn, map[string]json.RawMessage{}, params)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) || queryErr.Code != code {
+			t.Errorf("%s: expected %s, got: %v", query, code, err)
+		}
+	}
+}
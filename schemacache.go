@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SchemaCache holds the tables, columns and constraints of one tenant schema,
+// loaded from pg_catalog the first time the schema is used
+type SchemaCache struct {
+	Schema      string
+	Tables      map[string]*Table
+	ForeignKeys []ForeignKey
+}
+
+// Table describes a table, view or materialized view in the schema
+type Table struct {
+	Name        string
+	Columns     []string
+	ColumnTypes map[string]string // column name to its type as rendered by format_type
+	PrimaryKey  []string
+}
+
+// HasColumn reports whether the table has a column with this name
+func (t *Table) HasColumn(name string) bool {
+	for _, c := range t.Columns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ColumnType returns the type of a column, or "" when the table or column is unknown
+func (t *Table) ColumnType(name string) string {
+	if t == nil {
+		return ""
+	}
+	return t.ColumnTypes[name]
+}
+
+// ForeignKey is a foreign key constraint from Table.Columns to RefTable.RefColumns
+type ForeignKey struct {
+	Name       string
+	Table      string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+}
+
+// Relationship describes how an embedded resource is reached from its parent table
+type Relationship struct {
+	Parent   string
+	Target   string
+	ToOne    bool // many-to-one: the parent holds the foreign key
+	FK       ForeignKey
+	Junction *Junction // set for many-to-many relationships, FK is unused then
+}
+
+// Hint is the name that selects this relationship in an embed hint
+func (r Relationship) Hint() string {
+	if r.Junction != nil {
+		return r.Junction.Table
+	}
+	return r.FK.Name
+}
+
+// String describes the relationship for error messages
+func (r Relationship) String() string {
+	switch {
+	case r.Junction != nil:
+		return fmt.Sprintf("%s (many-to-many: %s -> %s -> %s)", r.Hint(), r.Parent, r.Junction.Table, r.Target)
+	case r.ToOne:
+		return fmt.Sprintf("%s (many-to-one: %s(%s) -> %s(%s))", r.Hint(),
+			r.FK.Table, strings.Join(r.FK.Columns, ","), r.FK.RefTable, strings.Join(r.FK.RefColumns, ","))
+	default:
+		return fmt.Sprintf("%s (one-to-many: %s(%s) -> %s(%s))", r.Hint(),
+			r.FK.Table, strings.Join(r.FK.Columns, ","), r.FK.RefTable, strings.Join(r.FK.RefColumns, ","))
+	}
+}
+
+// matchesHint reports whether hint names the constraint, junction table or
+// single foreign key column behind the relationship
+func (r Relationship) matchesHint(hint string) bool {
+	if r.Junction != nil {
+		return hint == r.Junction.Table || hint == r.Junction.ParentFK.Name || hint == r.Junction.TargetFK.Name
+	}
+	return hint == r.FK.Name || (len(r.FK.Columns) == 1 && r.FK.Columns[0] == hint)
+}
+
+// Junction is a table whose primary key links two tables through foreign keys
+type Junction struct {
+	Table    string
+	ParentFK ForeignKey // junction -> parent
+	TargetFK ForeignKey // junction -> target
+}
+
+// RelationshipError is returned when an embed does not match any foreign key
+type RelationshipError struct {
+	Parent string
+	Embed  string
+}
+
+func (e *RelationshipError) Error() string {
+	return fmt.Sprintf("could not find a relationship between '%s' and '%s' in the schema cache", e.Parent, e.Embed)
+}
+
+// AmbiguousRelationshipError is returned when several foreign keys match an embed
+// and no hint picks one of them
+type AmbiguousRelationshipError struct {
+	Parent     string
+	Embed      string
+	Candidates []Relationship
+}
+
+func (e *AmbiguousRelationshipError) Error() string {
+	candidates := make([]string, len(e.Candidates))
+	for i, rel := range e.Candidates {
+		candidates[i] = rel.String()
+	}
+	return fmt.Sprintf(
+		"more than one relationship was found for '%s' and '%s'; pick one with '%s!<hint>(...)' using one of: %s",
+		e.Parent, e.Embed, e.Embed, strings.Join(candidates, "; "),
+	)
+}
+
+// schemaCaches keeps one loaded SchemaCache per tenant schema. generation counts
+// the reloads so a cache loaded before a reload is not stored after it.
+var schemaCaches = struct {
+	sync.RWMutex
+	bySchema   map[string]*SchemaCache
+	generation int
+}{bySchema: make(map[string]*SchemaCache)}
+
+// reloadSchemaCaches drops every loaded cache so each tenant schema is read again on its next request
+func reloadSchemaCaches() {
+	schemaCaches.Lock()
+	schemaCaches.bySchema = make(map[string]*SchemaCache)
+	schemaCaches.generation++
+	schemaCaches.Unlock()
+}
+
+// getSchemaCache returns the cache for the tenant schema in ctx, loading it on first use
+func getSchemaCache(ctx context.Context, db Querier) (*SchemaCache, error) {
+	schema := tenantFromContext(ctx)
+	if schema == "" {
+		return nil, errors.New("no tenant schema in request context")
+	}
+
+	schemaCaches.RLock()
+	cache, ok := schemaCaches.bySchema[schema]
+	generation := schemaCaches.generation
+	schemaCaches.RUnlock()
+	if ok {
+		return cache, nil
+	}
+
+	cache, err := loadSchemaCache(ctx, db, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaCaches.Lock()
+	if schemaCaches.generation == generation {
+		schemaCaches.bySchema[schema] = cache
+	}
+	schemaCaches.Unlock()
+	return cache, nil
+}
+
+// columnsQuery lists the columns of every relation in a schema, with their types, in attribute order
+const columnsQuery = `
+	SELECT c.relname, a.attname, format_type(a.atttypid, a.atttypmod)
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+	WHERE n.nspname = $1 AND c.relkind IN ('r', 'v', 'm', 'f', 'p')
+	ORDER BY c.relname, a.attnum
+`
+
+// constraintsQuery lists primary keys and the foreign keys that stay inside a schema
+const constraintsQuery = `
+	SELECT con.conname, con.contype::text, c.relname,
+		ARRAY(
+			SELECT a.attname::text FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+			JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+			ORDER BY k.ord
+		),
+		COALESCE(fc.relname, ''),
+		ARRAY(
+			SELECT a.attname::text FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, ord)
+			JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+			ORDER BY k.ord
+		)
+	FROM pg_constraint con
+	JOIN pg_class c ON c.oid = con.conrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	LEFT JOIN pg_class fc ON fc.oid = con.confrelid
+	WHERE n.nspname = $1
+		AND (con.contype = 'p' OR (con.contype = 'f' AND fc.relnamespace = n.oid))
+	ORDER BY c.relname, con.conname
+`
+
+// loadSchemaCache reads tables, columns, primary keys and foreign keys of schema from pg_catalog
+func loadSchemaCache(ctx context.Context, db Querier, schema string) (*SchemaCache, error) {
+	cache := &SchemaCache{Schema: schema, Tables: make(map[string]*Table)}
+
+	rows, err := db.Query(ctx, columnsQuery, schema)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var table, column, typ string
+		if err := rows.Scan(&table, &column, &typ); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t, ok := cache.Tables[table]
+		if !ok {
+			t = &Table{Name: table, ColumnTypes: make(map[string]string)}
+			cache.Tables[table] = t
+		}
+		t.Columns = append(t.Columns, column)
+		t.ColumnTypes[column] = typ
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(ctx, constraintsQuery, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, kind, table, refTable string
+		var columns, refColumns []string
+		if err := rows.Scan(&name, &kind, &table, &columns, &refTable, &refColumns); err != nil {
+			return nil, err
+		}
+		if kind == "p" {
+			if t, ok := cache.Tables[table]; ok {
+				t.PrimaryKey = columns
+			}
+			continue
+		}
+		cache.ForeignKeys = append(cache.ForeignKeys, ForeignKey{
+			Name:       name,
+			Table:      table,
+			Columns:    columns,
+			RefTable:   refTable,
+			RefColumns: refColumns,
+		})
+	}
+	return cache, rows.Err()
+}
+
+// Relationships lists every foreign key that lets parent embed the resource called name.
+// name may be the related table or, for many-to-one embeds, the foreign key column
+// with or without its _id suffix (posts?select=author(*) for posts.author_id).
+func (sc *SchemaCache) Relationships(parent, name string) []Relationship {
+	var rels []Relationship
+	for _, fk := range sc.ForeignKeys {
+		if fk.Table == parent && (fk.RefTable == name || fkColumnMatches(fk, name)) {
+			rels = append(rels, Relationship{Parent: parent, Target: fk.RefTable, ToOne: true, FK: fk})
+		}
+		if fk.RefTable == parent && fk.Table == name {
+			rels = append(rels, Relationship{Parent: parent, Target: fk.Table, FK: fk})
+		}
+	}
+	return append(rels, sc.junctionRelationships(parent, name)...)
+}
+
+// junctionRelationships finds many-to-many relationships between parent and target.
+// A junction table needs a foreign key to each side, with both keys inside its primary key.
+func (sc *SchemaCache) junctionRelationships(parent, target string) []Relationship {
+	var rels []Relationship
+	for _, parentFK := range sc.ForeignKeys {
+		if parentFK.RefTable != parent || parentFK.Table == parent || parentFK.Table == target {
+			continue
+		}
+		junction, ok := sc.Tables[parentFK.Table]
+		if !ok || !containsAll(junction.PrimaryKey, parentFK.Columns) {
+			continue
+		}
+		for _, targetFK := range sc.ForeignKeys {
+			if targetFK.Table != junction.Name || targetFK.RefTable != target || targetFK.Name == parentFK.Name {
+				continue
+			}
+			if !containsAll(junction.PrimaryKey, targetFK.Columns) {
+				continue
+			}
+			rels = append(rels, Relationship{
+				Parent:   parent,
+				Target:   target,
+				Junction: &Junction{Table: junction.Name, ParentFK: parentFK, TargetFK: targetFK},
+			})
+		}
+	}
+	return rels
+}
+
+// containsAll reports whether every value of subset is in set
+func containsAll(set, subset []string) bool {
+	for _, v := range subset {
+		found := false
+		for _, s := range set {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// fkColumnMatches reports whether name refers to the single column of fk
+func fkColumnMatches(fk ForeignKey, name string) bool {
+	return len(fk.Columns) == 1 && (fk.Columns[0] == name || fk.Columns[0] == name+"_id")
+}
+
+// FindRelationship resolves the embed called name on parent from the foreign keys.
+// hint, when set, picks a relationship by constraint name, foreign key column or
+// junction table; without it more than one match is reported as ambiguous.
+func (sc *SchemaCache) FindRelationship(parent, name, hint string) (Relationship, error) {
+	rels := sc.Relationships(parent, name)
+	if hint != "" {
+		var hinted []Relationship
+		for _, rel := range rels {
+			if rel.matchesHint(hint) {
+				hinted = append(hinted, rel)
+			}
+		}
+		rels = hinted
+	}
+
+	switch len(rels) {
+	case 0:
+		return Relationship{}, &RelationshipError{Parent: parent, Embed: name}
+	case 1:
+		return rels[0], nil
+	default:
+		return Relationship{}, &AmbiguousRelationshipError{Parent: parent, Embed: name, Candidates: rels}
+	}
+}
+
+// PrimaryKey returns the primary key columns of table, or nil when it is unknown
+func (sc *SchemaCache) PrimaryKey(table string) []string {
+	if t, ok := sc.Tables[table]; ok {
+		return t.PrimaryKey
+	}
+	return nil
+}
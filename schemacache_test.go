@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testSchema is the schema name the cached fixture below is registered under
+const testSchema = "pgrst_test"
+
+// testSchemaCache builds a cache mirroring the authors/posts/stats test tables
+func testSchemaCache() *SchemaCache {
+	return &SchemaCache{
+		Schema: testSchema,
+		Tables: map[string]*Table{
+			"authors": {Name: "authors", Columns: []string{"id", "first_name", "last_name"}, PrimaryKey: []string{"id"}},
+			"posts":   {Name: "posts", Columns: []string{"id", "content", "author_id", "editor_id"}, PrimaryKey: []string{"id"}},
+			"stats":   {Name: "stats", Columns: []string{"id", "views", "post_id"}, PrimaryKey: []string{"id"}},
+			"tags":    {Name: "tags", Columns: []string{"id", "name"}, PrimaryKey: []string{"id"}},
+			"users":   {Name: "users", Columns: []string{"id", "email", "name"}, PrimaryKey: []string{"id"}},
+			"documents": {
+				Name:        "documents",
+				Columns:     []string{"id", "metadata"},
+				ColumnTypes: map[string]string{"id": "integer", "metadata": "jsonb"},
+				PrimaryKey:  []string{"id"},
+			},
+			"author_tags": {
+				Name:       "author_tags",
+				Columns:    []string{"author_id", "tag_id"},
+				PrimaryKey: []string{"author_id", "tag_id"},
+			},
+		},
+		ForeignKeys: []ForeignKey{
+			{Name: "posts_author_id_fkey", Table: "posts", Columns: []string{"author_id"}, RefTable: "authors", RefColumns: []string{"id"}},
+			{Name: "posts_editor_id_fkey", Table: "posts", Columns: []string{"editor_id"}, RefTable: "authors", RefColumns: []string{"id"}},
+			{Name: "stats_post_id_fkey", Table: "stats", Columns: []string{"post_id"}, RefTable: "posts", RefColumns: []string{"id"}},
+			{Name: "author_tags_author_id_fkey", Table: "author_tags", Columns: []string{"author_id"}, RefTable: "authors", RefColumns: []string{"id"}},
+			{Name: "author_tags_tag_id_fkey", Table: "author_tags", Columns: []string{"tag_id"}, RefTable: "tags", RefColumns: []string{"id"}},
+		},
+	}
+}
+
+// testContext registers the fixture cache and returns a context scoped to it
+func testContext() context.Context {
+	schemaCaches.Lock()
+	schemaCaches.bySchema[testSchema] = testSchemaCache()
+	schemaCaches.Unlock()
+	return context.WithValue(context.Background(), tenantKey{}, testSchema)
+}
+
+// TestFindRelationship tests relationship resolution from foreign keys
+func TestFindRelationship(t *testing.T) {
+	cache := testSchemaCache()
+
+	tests := []struct {
+		parent, embed string
+		target        string
+		toOne         bool
+	}{
+		{"posts", "author", "authors", true},
+		{"posts", "editor", "authors", true},
+		{"posts", "author_id", "authors", true},
+		{"posts", "stats", "stats", false},
+	}
+	for _, test := range tests {
+		rel, err := cache.FindRelationship(test.parent, test.embed, "")
+		if err != nil {
+			t.Errorf("%s -> %s: unexpected error: %v", test.parent, test.embed, err)
+			continue
+		}
+		if rel.Target != test.target || rel.ToOne != test.toOne {
+			t.Errorf("%s -> %s: got target %s (to-one %v)", test.parent, test.embed, rel.Target, rel.ToOne)
+		}
+	}
+
+	_, err := cache.FindRelationship("authors", "stats", "")
+	var relErr *RelationshipError
+	if !errors.As(err, &relErr) {
+		t.Errorf("Expected a RelationshipError for unrelated tables, got: %v", err)
+	}
+}
+
+// TestBuildQueryEmbedsFromForeignKeys tests that embeds join on the real constraint columns
+func TestBuildQueryEmbedsFromForeignKeys(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,posts!author_id(id,stats(views))")
+	sql, err := BuildQuery(testContext(), nil, "authors", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		`FROM "posts" AS "posts_1" WHERE "posts_1"."author_id" = "authors"."id"`,
+		`FROM "stats" AS "stats_2" WHERE "stats_2"."post_id" = "posts_1"."id"`,
+	} {
+		if !strings.Contains(sql.Query, want) {
+			t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+		}
+	}
+
+	params, _ = url.ParseQuery("select=id,comments(id)")
+	if _, err := BuildQuery(testContext(), nil, "authors", params); err == nil {
+		t.Errorf("Expected an error for an unknown relationship")
+	}
+}
+
+// TestBuildQueryManyToMany tests embedding through a junction table
+func TestBuildQueryManyToMany(t *testing.T) {
+	rel, err := testSchemaCache().FindRelationship("authors", "tags", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rel.Junction == nil || rel.Junction.Table != "author_tags" {
+		t.Fatalf("Expected a relationship through author_tags, got: %+v", rel)
+	}
+
+	params, _ := url.ParseQuery("select=id,tags(name)")
+	sql, err := BuildQuery(testContext(), nil, "authors", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := `FROM "tags" AS "tags_1" WHERE EXISTS (SELECT 1 FROM "author_tags" AS "author_tags_1" ` +
+		`WHERE "author_tags_1"."tag_id" = "tags_1"."id" AND "author_tags_1"."author_id" = "authors"."id")`
+	if !strings.Contains(sql.Query, want) {
+		t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+	}
+}
+
+// TestFindRelationshipHints tests that hints pick one of several foreign keys to the same table
+func TestFindRelationshipHints(t *testing.T) {
+	cache := testSchemaCache()
+
+	_, err := cache.FindRelationship("posts", "authors", "")
+	var ambiguousErr *AmbiguousRelationshipError
+	if !errors.As(err, &ambiguousErr) {
+		t.Fatalf("Expected an ambiguity error, got: %v", err)
+	}
+	if len(ambiguousErr.Candidates) != 2 || !strings.Contains(err.Error(), "posts_editor_id_fkey") {
+		t.Errorf("Expected both candidates to be listed, got: %v", err)
+	}
+
+	for hint, column := range map[string]string{
+		"posts_author_id_fkey": "author_id",
+		"editor_id":            "editor_id",
+	} {
+		rel, err := cache.FindRelationship("posts", "authors", hint)
+		if err != nil {
+			t.Errorf("Hint %s: unexpected error: %v", hint, err)
+			continue
+		}
+		if rel.FK.Columns[0] != column {
+			t.Errorf("Hint %s: expected relationship on %s, got %s", hint, column, rel.FK.Columns[0])
+		}
+	}
+
+	rel, err := cache.FindRelationship("authors", "posts", "editor_id")
+	if err != nil || rel.ToOne || rel.FK.Columns[0] != "editor_id" {
+		t.Errorf("Expected the one-to-many relationship through editor_id, got %+v (%v)", rel, err)
+	}
+
+	if _, err := cache.FindRelationship("posts", "authors", "no_such_fkey"); err == nil {
+		t.Errorf("Expected an error for a hint that matches nothing")
+	}
+}
+
+// TestBuildQueryHintWithInner tests that a hint can be combined with !inner
+func TestBuildQueryHintWithInner(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,posts!editor_id!inner(id)")
+	sql, err := BuildQuery(testContext(), nil, "authors", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(sql.Query, `"posts_1"."editor_id" = "authors"."id"`) || strings.Contains(sql.Query, "COALESCE") {
+		t.Errorf("Expected an inner embed through editor_id, got: %s", sql.Query)
+	}
+
+	params, _ = url.ParseQuery("select=id,posts!editor_id!author_id(id)")
+	if _, err := BuildQuery(testContext(), nil, "authors", params); !errors.Is(err, errInvalidSelect) {
+		t.Errorf("Expected errInvalidSelect for two hints, got: %v", err)
+	}
+}
+
+// TestReloadSchemaCaches tests that a reload drops the loaded caches
+func TestReloadSchemaCaches(t *testing.T) {
+	testContext()
+	reloadSchemaCaches()
+
+	schemaCaches.RLock()
+	_, ok := schemaCaches.bySchema[testSchema]
+	schemaCaches.RUnlock()
+	if ok {
+		t.Errorf("Expected the %s cache to be dropped", testSchema)
+	}
+}
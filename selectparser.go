@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// errInvalidSelect is wrapped by every error in the select= syntax
+var errInvalidSelect = errors.New("invalid select")
+
+// SelectItem is one entry of a select= list: a column or an embedded resource
+type SelectItem struct {
+	Pos      int        // byte offset of the item in the select string
+	Alias    string     // alias:... renames the item in the JSON output
+	Column   string     // column name, or "*" for every column; empty for embeds
+	JSONPath []JSONStep // ->key and ->>key steps into a json or jsonb column
+	Cast     string     // ::type cast applied to the column
+	Embed    *Embed
+}
+
+// JSONStep is one -> or ->> step of a JSON path. Keys made of digits index arrays.
+type JSONStep struct {
+	Key  string
+	Text bool // ->> returns the value as text rather than json
+}
+
+// Key is the JSON key of the item in the response: its alias, else the embed name,
+// the last key of its JSON path or the column name
+func (item SelectItem) Key() string {
+	switch {
+	case item.Alias != "":
+		return item.Alias
+	case item.Embed != nil:
+		return item.Embed.Name
+	case len(item.JSONPath) > 0:
+		return item.JSONPath[len(item.JSONPath)-1].Key
+	default:
+		return item.Column
+	}
+}
+
+// Embed is an embedded resource like posts!fk_name!inner(id,content)
+type Embed struct {
+	Name   string
+	Hint   string // relationship hint: constraint name, foreign key column or junction table
+	Inner  bool   // !inner drops parent rows without a match
+	Select []SelectItem
+}
+
+// SelectParseError reports malformed select syntax at a position in the input
+type SelectParseError struct {
+	Input string
+	Pos   int
+	Msg   string
+}
+
+func (e *SelectParseError) Error() string {
+	return fmt.Sprintf("invalid select at position %d: %s (in %q)", e.Pos+1, e.Msg, e.Input)
+}
+
+// Unwrap lets callers match every parse error with errors.Is(err, errInvalidSelect)
+func (e *SelectParseError) Unwrap() error {
+	return errInvalidSelect
+}
+
+type selectTokenKind int
+
+const (
+	tokEOF selectTokenKind = iota
+	tokIdent
+	tokStar
+	tokComma
+	tokLParen
+	tokRParen
+	tokBang
+	tokColon
+	tokDoubleColon
+	tokArrow     // ->
+	tokTextArrow // ->>
+)
+
+// selectToken is a lexical token of the select grammar
+type selectToken struct {
+	kind   selectTokenKind
+	text   string
+	pos    int
+	quoted bool // identifier was written in double quotes
+}
+
+// describe names the token for error messages
+func (t selectToken) describe() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokIdent:
+		return fmt.Sprintf("%q", t.text)
+	default:
+		return fmt.Sprintf("'%s'", t.text)
+	}
+}
+
+// tokenizeSelect splits a select string into tokens, skipping whitespace
+func tokenizeSelect(input string) ([]selectToken, error) {
+	var tokens []selectToken
+	runes := []rune(input)
+	// byte offsets of each rune, so positions match the original string
+	offsets := make([]int, len(runes)+1)
+	off := 0
+	for i, r := range runes {
+		offsets[i] = off
+		off += len(string(r))
+	}
+	offsets[len(runes)] = off
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := offsets[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == ',':
+			tokens = append(tokens, selectToken{kind: tokComma, text: ",", pos: pos})
+			i++
+		case r == '(':
+			tokens = append(tokens, selectToken{kind: tokLParen, text: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, selectToken{kind: tokRParen, text: ")", pos: pos})
+			i++
+		case r == '!':
+			tokens = append(tokens, selectToken{kind: tokBang, text: "!", pos: pos})
+			i++
+		case r == '*':
+			tokens = append(tokens, selectToken{kind: tokStar, text: "*", pos: pos})
+			i++
+		case r == ':':
+			if i+1 < len(runes) && runes[i+1] == ':' {
+				tokens = append(tokens, selectToken{kind: tokDoubleColon, text: "::", pos: pos})
+				i += 2
+			} else {
+				tokens = append(tokens, selectToken{kind: tokColon, text: ":", pos: pos})
+				i++
+			}
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '>':
+			if i+2 < len(runes) && runes[i+2] == '>' {
+				tokens = append(tokens, selectToken{kind: tokTextArrow, text: "->>", pos: pos})
+				i += 3
+			} else {
+				tokens = append(tokens, selectToken{kind: tokArrow, text: "->", pos: pos})
+				i += 2
+			}
+		case r == '"':
+			// Quoted identifier, "" escapes a quote
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(runes) {
+					return nil, &SelectParseError{Input: input, Pos: pos, Msg: "unterminated quoted identifier"}
+				}
+				if runes[j] == '"' {
+					if j+1 < len(runes) && runes[j+1] == '"' {
+						b.WriteRune('"')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteRune(runes[j])
+				j++
+			}
+			if b.Len() == 0 {
+				return nil, &SelectParseError{Input: input, Pos: pos, Msg: "empty quoted identifier"}
+			}
+			tokens = append(tokens, selectToken{kind: tokIdent, text: b.String(), pos: pos, quoted: true})
+			i = j + 1
+		case isIdentRune(r):
+			j := i
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, selectToken{kind: tokIdent, text: string(runes[i:j]), pos: pos})
+			i = j
+		default:
+			return nil, &SelectParseError{Input: input, Pos: pos, Msg: fmt.Sprintf("unexpected character '%c'", r)}
+		}
+	}
+	return append(tokens, selectToken{kind: tokEOF, pos: len(input)}), nil
+}
+
+// isIdentRune reports whether r may appear in an unquoted identifier
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// selectParser is a recursive-descent parser over the select tokens
+type selectParser struct {
+	input  string
+	tokens []selectToken
+	pos    int
+}
+
+// ParseSelect parses a select= string into its AST. An empty string yields no items,
+// which callers treat as selecting every column.
+func ParseSelect(input string) ([]SelectItem, error) {
+	tokens, err := tokenizeSelect(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectParser{input: input, tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+
+	items, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		if tok.kind == tokRParen {
+			return nil, p.errorAt(tok, "unbalanced ')'")
+		}
+		return nil, p.errorAt(tok, "expected ',' or end of input, found "+tok.describe())
+	}
+	return items, nil
+}
+
+func (p *selectParser) peek() selectToken {
+	return p.tokens[p.pos]
+}
+
+func (p *selectParser) next() selectToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *selectParser) errorAt(tok selectToken, msg string) error {
+	return &SelectParseError{Input: p.input, Pos: tok.pos, Msg: msg}
+}
+
+// parseList parses item (',' item)*
+func (p *selectParser) parseList() ([]SelectItem, error) {
+	var items []SelectItem
+	for {
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.peek().kind != tokComma {
+			return items, nil
+		}
+		p.next()
+	}
+}
+
+// parseItem parses [alias ':'] ( '*' | name (arrow key)* ['::' type] | name ('!' marker)* '(' [list] ')' )
+func (p *selectParser) parseItem() (SelectItem, error) {
+	tok := p.next()
+	item := SelectItem{Pos: tok.pos}
+
+	switch tok.kind {
+	case tokStar:
+		item.Column = "*"
+		return item, nil
+	case tokIdent:
+	case tokComma, tokRParen, tokEOF:
+		return item, p.errorAt(tok, "expected a column or embedded resource, found "+tok.describe())
+	default:
+		return item, p.errorAt(tok, "unexpected "+tok.describe())
+	}
+
+	if p.peek().kind == tokColon {
+		p.next()
+		item.Alias = tok.text
+		tok = p.next()
+		if tok.kind != tokIdent {
+			return item, p.errorAt(tok, fmt.Sprintf("expected a column or embedded resource after alias %q, found %s", item.Alias, tok.describe()))
+		}
+	}
+
+	if p.peek().kind == tokBang || p.peek().kind == tokLParen {
+		embed, err := p.parseEmbed(tok)
+		if err != nil {
+			return item, err
+		}
+		item.Embed = embed
+		return item, nil
+	}
+
+	item.Column = tok.text
+	for p.peek().kind == tokArrow || p.peek().kind == tokTextArrow {
+		arrow := p.next()
+		if n := len(item.JSONPath); n > 0 && item.JSONPath[n-1].Text {
+			return item, p.errorAt(arrow, "'->>' returns text and must be the last step of a JSON path")
+		}
+		key := p.next()
+		if key.kind != tokIdent {
+			return item, p.errorAt(key, fmt.Sprintf("expected a JSON key after '%s', found %s", arrow.text, key.describe()))
+		}
+		item.JSONPath = append(item.JSONPath, JSONStep{Key: key.text, Text: arrow.kind == tokTextArrow})
+	}
+	if p.peek().kind == tokDoubleColon {
+		p.next()
+		typeTok := p.next()
+		if typeTok.kind != tokIdent || typeTok.quoted {
+			return item, p.errorAt(typeTok, "expected a type name after '::', found "+typeTok.describe())
+		}
+		item.Cast = typeTok.text
+	}
+	return item, nil
+}
+
+// parseEmbed parses the markers and parenthesized select list after an embed name
+func (p *selectParser) parseEmbed(name selectToken) (*Embed, error) {
+	embed := &Embed{Name: name.text}
+	for p.peek().kind == tokBang {
+		p.next()
+		marker := p.next()
+		if marker.kind != tokIdent {
+			return nil, p.errorAt(marker, "expected a join type or relationship hint after '!', found "+marker.describe())
+		}
+		switch marker.text {
+		case "inner":
+			embed.Inner = true
+		case "left":
+			embed.Inner = false
+		default:
+			if embed.Hint != "" {
+				return nil, p.errorAt(marker, fmt.Sprintf("embed %q has more than one hint (%s, %s)", embed.Name, embed.Hint, marker.text))
+			}
+			embed.Hint = marker.text
+		}
+	}
+
+	open := p.next()
+	if open.kind != tokLParen {
+		return nil, p.errorAt(open, fmt.Sprintf("expected '(' after embed %q, found %s", embed.Name, open.describe()))
+	}
+	if p.peek().kind != tokRParen {
+		items, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		embed.Select = items
+	}
+	if tok := p.next(); tok.kind != tokRParen {
+		if tok.kind == tokEOF {
+			return nil, p.errorAt(open, fmt.Sprintf("unclosed '(' for embed %q", embed.Name))
+		}
+		return nil, p.errorAt(tok, "expected ',' or ')', found "+tok.describe())
+	}
+	return embed, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseSelect tests the AST built for columns, aliases, casts and nested embeds
+func TestParseSelect(t *testing.T) {
+	items, err := ParseSelect(`id, title:name, price::text, "Full Name", posts!author_id!inner(id, stats(*))`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []SelectItem{
+		{Pos: 0, Column: "id"},
+		{Pos: 4, Alias: "title", Column: "name"},
+		{Pos: 16, Column: "price", Cast: "text"},
+		{Pos: 29, Column: "Full Name"},
+		{Pos: 42, Embed: &Embed{
+			Name:  "posts",
+			Hint:  "author_id",
+			Inner: true,
+			Select: []SelectItem{
+				{Pos: 64, Column: "id"},
+				{Pos: 68, Embed: &Embed{Name: "stats", Select: []SelectItem{{Pos: 74, Column: "*"}}}},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("Unexpected AST:\n got: %+v\nwant: %+v", items, want)
+	}
+
+	if items, err := ParseSelect(""); err != nil || items != nil {
+		t.Errorf("Expected no items for an empty select, got %v (%v)", items, err)
+	}
+}
+
+// TestParseSelectJSONPath tests -> and ->> steps, quoted keys and their JSON keys
+func TestParseSelectJSONPath(t *testing.T) {
+	items, err := ParseSelect(`data->tags->0, status:data->"a b"->>status::int`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := []SelectItem{
+		{Pos: 0, Column: "data", JSONPath: []JSONStep{{Key: "tags"}, {Key: "0"}}},
+		{Pos: 15, Alias: "status", Column: "data", JSONPath: []JSONStep{{Key: "a b"}, {Key: "status", Text: true}}, Cast: "int"},
+	}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("Unexpected AST:\n got: %+v\nwant: %+v", items, want)
+	}
+	if items[0].Key() != "0" || items[1].Key() != "status" {
+		t.Errorf("Expected keys 0 and status, got %s and %s", items[0].Key(), items[1].Key())
+	}
+}
+
+// TestParseSelectErrors tests that malformed select strings report the offending position
+func TestParseSelectErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+		msg   string
+	}{
+		{"id,,name", 3, "expected a column"},
+		{"id,", 3, "expected a column"},
+		{"posts(id", 5, "unclosed '('"},
+		{"id)", 2, "unbalanced ')'"},
+		{"posts!a!b(id)", 8, "more than one hint"},
+		{"price::", 7, "expected a type name"},
+		{`price::"text"`, 7, "expected a type name"},
+		{"id;drop", 2, "unexpected character ';'"},
+		{`"name`, 0, "unterminated quoted identifier"},
+		{"data->", 6, "expected a JSON key"},
+		{"data->>a->b", 8, "must be the last step"},
+		{"data-a", 4, "unexpected character '-'"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseSelect(tt.input)
+		var parseErr *SelectParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: expected a SelectParseError, got: %v", tt.input, err)
+			continue
+		}
+		if parseErr.Pos != tt.pos || !strings.Contains(parseErr.Msg, tt.msg) {
+			t.Errorf("%q: expected %q at %d, got %q at %d", tt.input, tt.msg, tt.pos, parseErr.Msg, parseErr.Pos)
+		}
+		if !errors.Is(err, errInvalidSelect) {
+			t.Errorf("%q: expected the error to wrap errInvalidSelect", tt.input)
+		}
+	}
+}
+
+// TestBuildQueryAliasAndCast tests that aliases and casts reach the generated SQL
+func TestBuildQueryAliasAndCast(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,title:content,author_id::text")
+	sql, err := BuildQuery(testContext(), nil, "posts", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `SELECT "id", "content" AS "title", CAST("author_id" AS text) AS "author_id" FROM "posts"`
+	if !strings.HasPrefix(sql.Query, want) {
+		t.Errorf("Expected query to start with %q, got: %s", want, sql.Query)
+	}
+}
+
+// TestBuildQueryEmbedAliases tests aliases and casts on embeds and on the columns inside them
+func TestBuildQueryEmbedAliases(t *testing.T) {
+	params, _ := url.ParseQuery("select=id,writer:authors!author_id(firstName:first_name,id::text,key:id::text)&writer.first_name=eq.Jo")
+	sql, err := BuildQuery(testContext(), nil, "posts", params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := `(SELECT row_to_json(arr) FROM (SELECT "authors_1"."first_name" AS "firstName", CAST("authors_1"."id" AS text) AS "id", CAST("authors_1"."id" AS text) AS "key" ` +
+		`FROM "authors" AS "authors_1" WHERE ("posts"."author_id" = "authors_1"."id" AND ("authors_1"."first_name" = $1)) LIMIT $2) arr) AS "writer"`
+	if !strings.Contains(sql.Query, want) {
+		t.Errorf("Expected %q in query, got: %s", want, sql.Query)
+	}
+	if len(sql.Values) == 0 || sql.Values[0] != "Jo" {
+		t.Errorf("Expected the embed filter value to be bound, got: %v", sql.Values)
+	}
+}
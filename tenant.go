@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// maxIdentifierLength is the longest identifier Postgres keeps (NAMEDATALEN - 1)
+const maxIdentifierLength = 63
+
+// tenantKey is the context key under which the tenant schema of a request is stored
+type tenantKey struct{}
+
+// tenantFromContext returns the tenant schema set by beginTenantTx
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantResolver identifies the tenant a request is addressed to
+type TenantResolver interface {
+	// Resolve returns the tenant named by r, or "" when r does not name one
+	// in the form this resolver understands
+	Resolve(r *http.Request) (string, error)
+	// Source describes where the resolver looks, for error messages
+	Source() string
+}
+
+// HeaderResolver reads the tenant from a request header such as X-Tenant-ID
+type HeaderResolver struct {
+	Header string
+}
+
+func (h HeaderResolver) Resolve(r *http.Request) (string, error) {
+	return strings.TrimSpace(r.Header.Get(h.Header)), nil
+}
+
+func (h HeaderResolver) Source() string {
+	return h.Header + " header"
+}
+
+// SubdomainResolver reads the tenant from the first label of the host,
+// e.g. acme for acme.api.example.com with BaseDomain api.example.com
+type SubdomainResolver struct {
+	BaseDomain string
+}
+
+func (s SubdomainResolver) Resolve(r *http.Request) (string, error) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, found := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(s.BaseDomain))
+	if !found || strings.Contains(label, ".") {
+		return "", nil
+	}
+	return label, nil
+}
+
+func (s SubdomainResolver) Source() string {
+	return "subdomain of " + s.BaseDomain
+}
+
+// PathPrefixResolver reads the tenant from the path segment after Prefix,
+// e.g. acme for /t/acme/authors with Prefix /t. TenantMiddleware strips the
+// prefix and tenant so the request is routed as /authors.
+type PathPrefixResolver struct {
+	Prefix string
+}
+
+func (p PathPrefixResolver) Resolve(r *http.Request) (string, error) {
+	rest, found := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(p.Prefix, "/")+"/")
+	if !found {
+		return "", nil
+	}
+	tenant, _, _ := strings.Cut(rest, "/")
+	return tenant, nil
+}
+
+func (p PathPrefixResolver) Source() string {
+	return strings.TrimSuffix(p.Prefix, "/") + "/{tenant} path prefix"
+}
+
+// stripTenant returns r with the prefix and tenant removed from its path
+func (p PathPrefixResolver) stripTenant(r *http.Request, tenant string) *http.Request {
+	u := *r.URL
+	u.Path = strings.TrimPrefix(u.Path, strings.TrimSuffix(p.Prefix, "/")+"/"+tenant)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = ""
+	stripped := r.Clone(r.Context())
+	stripped.URL = &u
+	return stripped
+}
+
+// JWTClaimResolver reads the tenant from a claim of the verified bearer token
+type JWTClaimResolver struct {
+	Claim string
+}
+
+func (j JWTClaimResolver) Resolve(r *http.Request) (string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", nil
+	}
+	claims, err := verifyJWT(token)
+	if err != nil {
+		return "", err
+	}
+	tenant, _ := claims[j.Claim].(string)
+	return tenant, nil
+}
+
+func (j JWTClaimResolver) Source() string {
+	return fmt.Sprintf("'%s' claim of the bearer token", j.Claim)
+}
+
+// tenantResolvers are tried in order by TenantMiddleware; the first one that finds
+// a tenant wins. main replaces the default from the TENANT_RESOLVERS configuration.
+var tenantResolvers = []TenantResolver{HeaderResolver{Header: "X-Tenant-ID"}}
+
+// loadTenantResolvers builds the resolver chain from configuration. TENANT_RESOLVERS
+// lists header, subdomain, path and jwt in priority order (default: header).
+func loadTenantResolvers(getenv func(string) string) ([]TenantResolver, error) {
+	withDefault := func(key, def string) string {
+		if v := getenv(key); v != "" {
+			return v
+		}
+		return def
+	}
+
+	var resolvers []TenantResolver
+	for _, name := range strings.Split(withDefault("TENANT_RESOLVERS", "header"), ",") {
+		switch strings.TrimSpace(name) {
+		case "header":
+			resolvers = append(resolvers, HeaderResolver{Header: withDefault("TENANT_HEADER", "X-Tenant-ID")})
+		case "subdomain":
+			domain := getenv("TENANT_DOMAIN")
+			if domain == "" {
+				return nil, errors.New("TENANT_DOMAIN is required for the subdomain tenant resolver")
+			}
+			resolvers = append(resolvers, SubdomainResolver{BaseDomain: domain})
+		case "path":
+			resolvers = append(resolvers, PathPrefixResolver{Prefix: withDefault("TENANT_PATH_PREFIX", "/t")})
+		case "jwt":
+			resolvers = append(resolvers, JWTClaimResolver{Claim: withDefault("TENANT_JWT_CLAIM", "tenant")})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown tenant resolver %q", name)
+		}
+	}
+	if len(resolvers) == 0 {
+		return nil, errors.New("TENANT_RESOLVERS lists no resolvers")
+	}
+	return resolvers, nil
+}
+
+// requestTenantKey is the context key under which TenantMiddleware stores the
+// tenant named by a request, before it has been checked against the database
+type requestTenantKey struct{}
+
+// TenantMiddleware resolves the tenant of every request with tenantResolvers and
+// stores it for beginTenantTx. Requests without a tenant are passed on unchanged.
+func TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, resolver := range tenantResolvers {
+			tenant, err := resolver.Resolve(r)
+			if errors.Is(err, errInvalidToken) {
+				writeError(w, http.StatusUnauthorized, errorResponse{Code: "invalid_token", Message: err.Error()})
+				return
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errorResponse{Code: "invalid_tenant", Message: err.Error()})
+				return
+			}
+			if tenant == "" {
+				continue
+			}
+			if p, ok := resolver.(PathPrefixResolver); ok {
+				r = p.stripTenant(r, tenant)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), requestTenantKey{}, tenant))
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// missingTenantMessage names every place a tenant could have been given
+func missingTenantMessage() string {
+	sources := make([]string, len(tenantResolvers))
+	for i, resolver := range tenantResolvers {
+		sources[i] = resolver.Source()
+	}
+	return "Missing " + strings.Join(sources, " or ")
+}
+
+// tenantQuery checks that a tenant schema exists. When registry names a table
+// (TENANT_REGISTRY, e.g. public.tenants) the tenant must also be listed in its
+// schema_name column; otherwise any schema that is not a Postgres system schema
+// is a tenant.
+func tenantQuery(registry string) string {
+	schemaExists := `EXISTS (
+		SELECT 1 FROM pg_namespace
+		WHERE nspname = $1 AND nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema'
+	)`
+	if registry == "" {
+		return "SELECT " + schemaExists
+	}
+	table := pgx.Identifier(strings.Split(registry, ".")).Sanitize()
+	return fmt.Sprintf("SELECT %s AND EXISTS (SELECT 1 FROM %s WHERE schema_name = $1)", schemaExists, table)
+}
+
+// tenantExists reports whether tenant names a schema the service may scope requests to
+func tenantExists(ctx context.Context, db Querier, tenant string) (bool, error) {
+	// Names Postgres would truncate or reject cannot match a schema
+	if len(tenant) > maxIdentifierLength || strings.ContainsRune(tenant, 0) {
+		return false, nil
+	}
+	var exists bool
+	err := db.QueryRow(ctx, tenantQuery(os.Getenv("TENANT_REGISTRY")), tenant).Scan(&exists)
+	return exists, err
+}
+
+// beginTenantTx opens a transaction scoped to the tenant found by TenantMiddleware and
+// returns a context carrying the tenant. The tenant is checked against the existing
+// schemas (or the registry) before it is used, and unknown tenants get a 404.
+// The transaction then runs as the role of the request's bearer token, with the
+// request itself exposed through the request.* settings, and the pre-request hook
+// gets a chance to reject it.
+// On failure the error response is already written and ok is false.
+func beginTenantTx(ctx context.Context, w http.ResponseWriter, r *http.Request) (context.Context, pgx.Tx, bool) {
+	tenant, _ := r.Context().Value(requestTenantKey{}).(string)
+	log.Println("Tenant ID:", tenant)
+	if tenant == "" {
+		writeError(w, http.StatusBadRequest, errorResponse{Code: "missing_tenant", Message: missingTenantMessage()})
+		return ctx, nil, false
+	}
+	role, claims, err := authenticate(r)
+	if err != nil {
+		code := "invalid_token"
+		if errors.Is(err, errAnonDisabled) {
+			code = "anonymous_disabled"
+		}
+		writeError(w, http.StatusUnauthorized, errorResponse{Code: code, Message: err.Error()})
+		return ctx, nil, false
+	}
+
+	tx, err := DB.Begin(ctx)
+	if err != nil {
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+
+	exists, err := tenantExists(ctx, tx, tenant)
+	if err != nil {
+		tx.Rollback(ctx)
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+	if !exists {
+		tx.Rollback(ctx)
+		writeError(w, http.StatusNotFound, errorResponse{
+			Code:    "unknown_tenant",
+			Message: fmt.Sprintf("Tenant %q not found", tenant),
+		})
+		return ctx, nil, false
+	}
+
+	// Tenant isolation: ensure queries are scoped to the tenant
+	log.Println("Setting the search path")
+	_, err = tx.Exec(ctx, "SET LOCAL search_path TO "+pgx.Identifier{tenant}.Sanitize())
+	if err != nil {
+		tx.Rollback(ctx)
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+
+	if err := switchRole(ctx, tx, role); err != nil {
+		tx.Rollback(ctx)
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+	if err := setRequestSettings(ctx, tx, r, tenant, claims); err != nil {
+		tx.Rollback(ctx)
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+	if err := runPreRequest(ctx, tx); err != nil {
+		tx.Rollback(ctx)
+		writeDBError(w, err)
+		return ctx, nil, false
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant), tx, true
+}
+
+// switchRole makes the rest of the transaction run as role, so row-level security
+// policies apply
+func switchRole(ctx context.Context, tx pgx.Tx, role string) error {
+	if role == "" {
+		return nil
+	}
+	_, err := tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{role}.Sanitize())
+	return err
+}
+
+// requestSettingsQuery exposes the request to SQL as transaction-local settings
+// readable with current_setting('request.method') and friends
+const requestSettingsQuery = `SELECT
+	set_config('request.jwt.claims', $1, true),
+	set_config('request.headers', $2, true),
+	set_config('request.cookies', $3, true),
+	set_config('request.method', $4, true),
+	set_config('request.path', $5, true),
+	set_config('request.tenant', $6, true)`
+
+// requestSettings returns the values bound to requestSettingsQuery. Headers and
+// cookies are JSON objects; header names are lower-cased and repeated headers joined.
+func requestSettings(r *http.Request, tenant string, claims jwt.MapClaims) ([]any, error) {
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	cookies := make(map[string]string)
+	for _, c := range r.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+
+	var values []any
+	for _, v := range []any{claims, headers, cookies} {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(encoded))
+	}
+	return append(values, r.Method, r.URL.Path, tenant), nil
+}
+
+// setRequestSettings stores the request settings in the transaction
+func setRequestSettings(ctx context.Context, tx pgx.Tx, r *http.Request, tenant string, claims jwt.MapClaims) error {
+	values, err := requestSettings(r, tenant, claims)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, requestSettingsQuery, values...)
+	return err
+}
+
+// preRequestFunction names a function called in every tenant transaction once the
+// search_path, role and request settings are in place (DB_PRE_REQUEST, optionally
+// schema-qualified). It rejects a request by raising an exception; the error is
+// reported like any other database error, and RAISE ... USING ERRCODE = 'PT403'
+// picks the HTTP status.
+var preRequestFunction string
+
+// runPreRequest calls the pre-request hook, if one is configured
+func runPreRequest(ctx context.Context, tx pgx.Tx) error {
+	if preRequestFunction == "" {
+		return nil
+	}
+	_, err := tx.Exec(ctx, preRequestQuery(preRequestFunction))
+	return err
+}
+
+// preRequestQuery quotes each part of a possibly schema-qualified function name
+func preRequestQuery(function string) string {
+	return "SELECT " + pgx.Identifier(strings.Split(function, ".")).Sanitize() + "()"
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TestTenantQuery tests that the registry table is quoted and the tenant is always bound
+func TestTenantQuery(t *testing.T) {
+	query := tenantQuery("")
+	if !strings.Contains(query, "nspname = $1") || strings.Contains(query, "schema_name") {
+		t.Errorf("Expected a pg_namespace lookup only, got: %s", query)
+	}
+
+	query = tenantQuery(`public.tenants"; DROP TABLE x; --`)
+	if !strings.Contains(query, `FROM "public"."tenants""; DROP TABLE x; --" WHERE schema_name = $1`) {
+		t.Errorf("Expected the registry to be quoted, got: %s", query)
+	}
+}
+
+// TestTenantExistsRejectsInvalidNames tests that impossible schema names never reach the database
+func TestTenantExistsRejectsInvalidNames(t *testing.T) {
+	for _, tenant := range []string{strings.Repeat("a", 64), "bad\x00name"} {
+		exists, err := tenantExists(context.Background(), nil, tenant)
+		if err != nil || exists {
+			t.Errorf("%q: expected an unknown tenant, got %v (%v)", tenant, exists, err)
+		}
+	}
+}
+
+// TestTenantResolvers tests each built-in way of naming a tenant
+func TestTenantResolvers(t *testing.T) {
+	defer func(saved AuthConfig) { authConfig = saved }(authConfig)
+	authConfig = AuthConfig{Secret: []byte("test-secret"), RoleClaim: "role"}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"tenant": "globex"}).SignedString(authConfig.Secret)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		resolver TenantResolver
+		target   string
+		header   string
+		value    string
+		want     string
+	}{
+		{HeaderResolver{Header: "X-Tenant-ID"}, "/authors", "X-Tenant-ID", "acme", "acme"},
+		{HeaderResolver{Header: "X-Tenant-ID"}, "/authors", "", "", ""},
+		{SubdomainResolver{BaseDomain: "api.example.com"}, "http://acme.api.example.com:8080/authors", "", "", "acme"},
+		{SubdomainResolver{BaseDomain: "api.example.com"}, "http://api.example.com/authors", "", "", ""},
+		{SubdomainResolver{BaseDomain: "api.example.com"}, "http://a.b.api.example.com/authors", "", "", ""},
+		{PathPrefixResolver{Prefix: "/t"}, "/t/acme/authors", "", "", "acme"},
+		{PathPrefixResolver{Prefix: "/t"}, "/authors", "", "", ""},
+		{JWTClaimResolver{Claim: "tenant"}, "/authors", "Authorization", "Bearer " + token, "globex"},
+		{JWTClaimResolver{Claim: "tenant"}, "/authors", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		got, err := tt.resolver.Resolve(req)
+		if err != nil || got != tt.want {
+			t.Errorf("%s on %s: expected %q, got %q (%v)", tt.resolver.Source(), tt.target, tt.want, got, err)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/authors", nil)
+	req.Header.Set("Authorization", "Bearer "+token+"x")
+	if _, err := (JWTClaimResolver{Claim: "tenant"}).Resolve(req); !errors.Is(err, errInvalidToken) {
+		t.Errorf("Expected errInvalidToken for a bad signature, got: %v", err)
+	}
+}
+
+// TestLoadTenantResolvers tests building the resolver chain from configuration
+func TestLoadTenantResolvers(t *testing.T) {
+	env := map[string]string{
+		"TENANT_RESOLVERS": "path, subdomain,header",
+		"TENANT_DOMAIN":    "api.example.com",
+		"TENANT_HEADER":    "X-Org",
+	}
+	resolvers, err := loadTenantResolvers(func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []TenantResolver{
+		PathPrefixResolver{Prefix: "/t"},
+		SubdomainResolver{BaseDomain: "api.example.com"},
+		HeaderResolver{Header: "X-Org"},
+	}
+	if !reflect.DeepEqual(resolvers, want) {
+		t.Errorf("Unexpected resolvers: %#v", resolvers)
+	}
+
+	for _, bad := range []string{"subdomain", "cookie", ","} {
+		if _, err := loadTenantResolvers(func(key string) string {
+			if key == "TENANT_RESOLVERS" {
+				return bad
+			}
+			return ""
+		}); err == nil {
+			t.Errorf("Expected an error for TENANT_RESOLVERS=%q", bad)
+		}
+	}
+}
+
+// TestTenantMiddleware tests resolver priority and that path prefixes are stripped before routing
+func TestTenantMiddleware(t *testing.T) {
+	defer func(saved []TenantResolver) { tenantResolvers = saved }(tenantResolvers)
+	tenantResolvers = []TenantResolver{PathPrefixResolver{Prefix: "/t"}, HeaderResolver{Header: "X-Tenant-ID"}}
+
+	var tenant, table string
+	r := chi.NewRouter()
+	r.Use(TenantMiddleware)
+	r.Get("/{table}", func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ = r.Context().Value(requestTenantKey{}).(string)
+		table = chi.URLParam(r, "table")
+	})
+
+	req := httptest.NewRequest("GET", "/t/acme/authors", nil)
+	req.Header.Set("X-Tenant-ID", "ignored")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if tenant != "acme" || table != "authors" {
+		t.Errorf("Expected tenant acme and table authors, got %q and %q", tenant, table)
+	}
+
+	req = httptest.NewRequest("GET", "/authors", nil)
+	req.Header.Set("X-Tenant-ID", "public")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if tenant != "public" || table != "authors" {
+		t.Errorf("Expected the header to be used without a prefix, got %q and %q", tenant, table)
+	}
+
+	if msg := missingTenantMessage(); msg != "Missing /t/{tenant} path prefix or X-Tenant-ID header" {
+		t.Errorf("Unexpected message: %s", msg)
+	}
+}
+
+// TestRequestSettings tests the values exposed to SQL as request.* settings
+func TestRequestSettings(t *testing.T) {
+	req := httptest.NewRequest("POST", "/authors?select=id", nil)
+	req.Header.Set("X-Tenant-ID", "acme")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Accept", "text/csv")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	values, err := requestSettings(req, "acme", jwt.MapClaims{"role": "editor"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(values[1].(string)), &headers); err != nil {
+		t.Fatalf("Expected headers as JSON: %v", err)
+	}
+	if headers["x-tenant-id"] != "acme" || headers["accept"] != "application/json,text/csv" {
+		t.Errorf("Unexpected headers: %v", headers)
+	}
+
+	want := []any{`{"role":"editor"}`, values[1], `{"session":"abc"}`, "POST", "/authors", "acme"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Unexpected settings: %v", values)
+	}
+}
+
+// TestPreRequestQuery tests that the hook name is quoted part by part
+func TestPreRequestQuery(t *testing.T) {
+	if got := preRequestQuery("auth.check_request"); got != `SELECT "auth"."check_request"()` {
+		t.Errorf("Unexpected query: %s", got)
+	}
+	if got := preRequestQuery(`hook"(); DROP TABLE x; --`); got != `SELECT "hook""(); DROP TABLE x; --"()` {
+		t.Errorf("Expected the name to be quoted, got: %s", got)
+	}
+}